@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/auth"
+	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
+	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
+	"github.com/gofiber/fiber/v2"
+	gguid "github.com/google/uuid"
+)
+
+const (
+	roomPasswordHeader = "X-Room-Password" // Header carrying the password of a room for clients without cookies
+	inviteQuery        = "invite"          // Query parameter carrying an invite code
+	maxPasswordLength  = 72                // Longest password bcrypt can hash
+)
+
+var (
+	errWrongPassword   = errors.New("wrong room password")
+	errInvalidInvite   = errors.New("invalid invite code")
+	errNotAdmitted     = errors.New("not admitted to the room")
+	errTooManyAttempts = errors.New("too many attempts, try again later")
+)
+
+// roomRequest is the body of a request creating a room.
+type roomRequest struct {
+	Password   string `json:"password" form:"password"`
+	InviteOnly bool   `json:"inviteOnly" form:"inviteOnly"`
+}
+
+type roomResponse struct {
+	RoomID     string `json:"roomId"`
+	RoomLink   string `json:"roomLink"`
+	StreamLink string `json:"streamLink"`
+}
+
+// HandleCreateRoom creates a room with the requested password and invite
+// mode. The user creating it owns and enters the room, unless tokens are
+// required and it has no host token.
+func (h *Handler) HandleCreateRoom(c *fiber.Ctx) error {
+	req := roomRequest{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+		}
+	}
+	if len(req.Password) > maxPasswordLength {
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	uuid := gguid.New().String()
+	room, err := h.createRoom(uuid, h.requestOwner(c, uuid), webrtc.RoomOptions{
+		Password:   req.Password,
+		InviteOnly: req.InviteOnly,
+	})
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(roomResponse{
+		RoomID:     uuid,
+		RoomLink:   fmt.Sprintf("%s://%s/room/%s", c.Protocol(), c.Hostname(), uuid),
+		StreamLink: fmt.Sprintf("%s://%s/stream/%s", c.Protocol(), c.Hostname(), room.Access.StreamKey),
+	})
+}
+
+// LimitRoomCreation rejects the requests creating a room once their address
+// created too many rooms recently. On routes naming a room, only requests for
+// rooms that are not open count.
+func (h *Handler) LimitRoomCreation(c *fiber.Ctx) error {
+	if uuid := c.Params("uuid"); uuid != "" {
+		if _, ok := h.Rooms.Get(uuid); ok {
+			return c.Next()
+		}
+	}
+	if !h.roomCreations.allow(c.IP(), time.Now()) {
+		return c.Status(fiber.StatusTooManyRequests).SendString("Too Many Requests")
+	}
+	return c.Next()
+}
+
+// RequireAdmission rejects requests for password protected and invite-only
+// rooms from users who did not enter them. The room is named by the uuid
+// parameter, or by the ssuid parameter of stream routes; closed protected
+// rooms stay protected and requests for unknown rooms are passed on.
+func (h *Handler) RequireAdmission(c *fiber.Ctx) error {
+	roomID, access, ok := h.routeAccess(c)
+	if !ok {
+		return c.Next()
+	}
+
+	switch err := h.admit(c, roomID, access); {
+	case errors.Is(err, errTooManyAttempts):
+		return c.Status(fiber.StatusTooManyRequests).SendString("Too Many Requests")
+	case err != nil:
+		return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+	}
+	return c.Next()
+}
+
+// routeAccess returns the ID and the access of the room named by the uuid or
+// ssuid parameter of a route.
+func (h *Handler) routeAccess(c *fiber.Ctx) (string, *webrtc.RoomAccess, bool) {
+	if uuid := c.Params("uuid"); uuid != "" {
+		access, ok := h.Rooms.Access(uuid)
+		return uuid, access, ok
+	}
+	room, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+	if !ok {
+		return "", nil, false
+	}
+	return room.ID, room.Access, true
+}
+
+// admit checks that the user of a request may enter a room. Users enter
+// through HandleJoinRoom, or on the way with the password in the
+// X-Room-Password header or an invite code in the invite query parameter. An
+// access token for the room lets its holder in, and so does the ID of a WHIP
+// or WHEP session opened by an admitted request.
+func (h *Handler) admit(c *fiber.Ctx, roomID string, access *webrtc.RoomAccess) error {
+	if !access.Protected() {
+		return nil
+	}
+	if claims := h.requestClaims(c); claims != nil && claims.RoomID == roomID {
+		return nil
+	}
+	if id, ok := h.verifyIdentity(c.Cookies(identityCookie)); ok && access.Admitted(id) {
+		return nil
+	}
+	if session := c.Params("sessionID"); session != "" && access.Admitted(session) {
+		return nil
+	}
+
+	password, invite := c.Get(roomPasswordHeader), c.Query(inviteQuery)
+	if password == "" && invite == "" {
+		return errNotAdmitted
+	}
+	return h.enterRoom(c, roomID, access, password, invite)
+}
+
+// enterRoom lets the user of a request into a room if the password matches
+// and, for invite-only rooms, the invite code is valid. The code is only used
+// up with the right password. Attempts are limited per address and room, a
+// room-wide limit would let anyone lock the others out.
+func (h *Handler) enterRoom(c *fiber.Ctx, roomID string, access *webrtc.RoomAccess, password, invite string) error {
+	if access.Protected() && !h.attempts.allow(c.IP()+" "+roomID, time.Now()) {
+		return errTooManyAttempts
+	}
+	if !access.CheckPassword(password) {
+		return errWrongPassword
+	}
+	if access.InviteOnly() && !access.RedeemInvite(invite) {
+		return errInvalidInvite
+	}
+
+	access.Admit(h.identity(c))
+	return nil
+}
+
+// joinRequest is the body of a request to enter a protected room.
+type joinRequest struct {
+	Password string `json:"password" form:"password"`
+	Invite   string `json:"invite" form:"invite"`
+}
+
+// HandleJoinRoom lets the user into a protected room with its password or an
+// invite code, also while the room is closed. The identity cookie of the user
+// is admitted on every route of the room.
+func (h *Handler) HandleJoinRoom(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+	access, ok := h.Rooms.Access(uuid)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Room Not Found")
+	}
+
+	req := joinRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	switch err := h.enterRoom(c, uuid, access, req.Password, req.Invite); {
+	case errors.Is(err, errTooManyAttempts):
+		return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+	case err != nil:
+		return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type inviteResponse struct {
+	Code string `json:"code"`
+	Link string `json:"link"`
+}
+
+// HandleCreateInvite creates a one-time invite code for an invite-only room.
+// Only the host of the room may invite, or a backend presenting the API key.
+func (h *Handler) HandleCreateInvite(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Room Not Found")
+	}
+	if !h.isRoomHost(c, room) {
+		return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+	}
+	if !room.Access.InviteOnly() {
+		return c.Status(fiber.StatusConflict).SendString("Room Is Not Invite-Only")
+	}
+
+	code := room.Access.NewInvite()
+	return c.Status(fiber.StatusCreated).JSON(inviteResponse{
+		Code: code,
+		Link: fmt.Sprintf("%s://%s/room/%s?%s=%s", c.Protocol(), c.Hostname(), room.ID, inviteQuery, code),
+	})
+}
+
+// isRoomHost reports whether a request comes from the owner of a room, from
+// the holder of a host token for it or from a backend with the API key.
+func (h *Handler) isRoomHost(c *fiber.Ctx, room *webrtc.CustomRoomManager) bool {
+	if h.Access.APIKey != "" && subtle.ConstantTimeCompare([]byte(c.Get(apiKeyHeader)), []byte(h.Access.APIKey)) == 1 {
+		return true
+	}
+	if claims := h.requestClaims(c); claims != nil {
+		return claims.RoomID == room.ID && claims.Role == auth.RoleHost
+	}
+
+	id, ok := h.verifyIdentity(c.Cookies(identityCookie))
+	return ok && room.Hub.Role(id) == customchat.RoleHost
+}
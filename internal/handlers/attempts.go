@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	maxAttempts      = 10          // Password and invite attempts per address, room and window
+	maxRoomCreations = 10          // Rooms created per address and window
+	attemptWindow    = time.Minute // Window in which the attempts are counted
+)
+
+// attemptLimiter counts attempts per key in fixed windows and rejects those
+// over the limit. It bounds the guesses of room passwords and invite codes,
+// the rooms created, and the bcrypt work they cost.
+type attemptLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	counts    map[string]*attemptCount
+	nextSweep time.Time
+}
+
+type attemptCount struct {
+	start    time.Time
+	attempts int
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]*attemptCount),
+	}
+}
+
+// allow records an attempt for key at the given time and reports whether it
+// is within the limit.
+func (l *attemptLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	count, ok := l.counts[key]
+	if !ok || now.Sub(count.start) >= l.window {
+		count = &attemptCount{start: now}
+		l.counts[key] = count
+	}
+	count.attempts++
+	return count.attempts <= l.limit
+}
+
+// sweep forgets the counts of the windows that ended, once per window.
+func (l *attemptLimiter) sweep(now time.Time) {
+	if now.Before(l.nextSweep) {
+		return
+	}
+	l.nextSweep = now.Add(l.window)
+
+	for key, count := range l.counts {
+		if now.Sub(count.start) >= l.window {
+			delete(l.counts, key)
+		}
+	}
+}
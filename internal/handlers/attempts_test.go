@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	type attempt struct {
+		key  string
+		at   time.Duration // After the first attempt
+		want bool
+	}
+
+	tests := []struct {
+		name     string
+		limit    int
+		attempts []attempt
+	}{
+		{
+			name:  "within the limit",
+			limit: 2,
+			attempts: []attempt{
+				{key: "a", want: true},
+				{key: "a", at: time.Second, want: true},
+			},
+		},
+		{
+			name:  "over the limit",
+			limit: 2,
+			attempts: []attempt{
+				{key: "a", want: true},
+				{key: "a", want: true},
+				{key: "a", at: 59 * time.Second, want: false},
+			},
+		},
+		{
+			name:  "keys counted apart",
+			limit: 1,
+			attempts: []attempt{
+				{key: "a", want: true},
+				{key: "b", want: true},
+				{key: "a", want: false},
+			},
+		},
+		{
+			name:  "new window",
+			limit: 1,
+			attempts: []attempt{
+				{key: "a", want: true},
+				{key: "a", at: 30 * time.Second, want: false},
+				{key: "a", at: time.Minute, want: true},
+				{key: "a", at: time.Minute, want: false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newAttemptLimiter(test.limit, time.Minute)
+			start := time.Now()
+
+			for i, attempt := range test.attempts {
+				if got := limiter.allow(attempt.key, start.Add(attempt.at)); got != attempt.want {
+					t.Errorf("allow(%q) #%d at %s = %v, want %v", attempt.key, i+1, attempt.at, got, attempt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAttemptLimiterSweep(t *testing.T) {
+	limiter := newAttemptLimiter(1, time.Minute)
+	start := time.Now()
+
+	limiter.allow("a", start)
+	limiter.allow("b", start.Add(30*time.Second))
+	limiter.allow("c", start.Add(time.Minute))
+
+	if _, ok := limiter.counts["a"]; ok {
+		t.Error("the count of an ended window was kept")
+	}
+	if _, ok := limiter.counts["b"]; !ok {
+		t.Error("the count of a current window was dropped")
+	}
+}
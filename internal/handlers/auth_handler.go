@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/auth"
+	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	gguid "github.com/google/uuid"
+)
+
+const (
+	claimsLocal     = "claims"       // Fiber local holding the verified token claims
+	tokenQuery      = "access_token" // Query parameter carrying the token of websockets
+	apiKeyHeader    = "X-API-Key"    // Header carrying the API key of the token endpoint
+	defaultTokenTTL = time.Hour      // Lifetime of the minted tokens unless requested otherwise
+	maxTokenTTL     = 24 * time.Hour // Longest lifetime of a minted token
+)
+
+// Access configures who may use the websockets of a Handler.
+type Access struct {
+	Tokens         *auth.Keys // Verifies the access tokens of the websockets, nil to let anyone in
+	APIKey         string     // Protects the token endpoint, which is disabled if empty
+	IdentitySecret []byte     // Signs the identity cookies, a random key for this process if empty
+}
+
+// RequireToken returns a middleware rejecting requests without a valid
+// access token for the room of the route granting at least role. The
+// room is named by the uuid parameter, or by the ssuid parameter of stream
+// routes. Requests pass unchecked when no token keys are configured.
+func (h *Handler) RequireToken(role auth.Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if h.Access.Tokens == nil {
+			return c.Next()
+		}
+
+		claims, err := h.Access.Tokens.Verify(requestToken(c))
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+
+		roomID := c.Params("uuid")
+		if roomID == "" {
+			stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+			if !ok {
+				return c.Status(fiber.StatusNotFound).SendString("Not Found")
+			}
+			roomID = stream.ID
+		}
+		if claims.RoomID != roomID || !claims.Role.AtLeast(role) {
+			return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+		}
+
+		c.Locals(claimsLocal, claims)
+		return c.Next()
+	}
+}
+
+// requestToken returns the bearer token of a request, or the token in its
+// query for browsers, which cannot set headers on websockets.
+func requestToken(c *fiber.Ctx) string {
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return token
+	}
+	return c.Query(tokenQuery)
+}
+
+// requestClaims returns the claims of the access token of a request, nil if
+// it has no valid token or tokens are not required.
+func (h *Handler) requestClaims(c *fiber.Ctx) *auth.Claims {
+	if claims, ok := c.Locals(claimsLocal).(*auth.Claims); ok {
+		return claims
+	}
+	if h.Access.Tokens == nil {
+		return nil
+	}
+
+	claims, err := h.Access.Tokens.Verify(requestToken(c))
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// websocketClaims returns the claims of the access token of a websocket, nil
+// if it was not checked.
+func websocketClaims(c *websocket.Conn) *auth.Claims {
+	claims, _ := c.Locals(claimsLocal).(*auth.Claims)
+	return claims
+}
+
+// websocketName returns the display name from the access token of a
+// websocket, or the one it asked for.
+func websocketName(c *websocket.Conn) string {
+	if claims := websocketClaims(c); claims != nil && claims.Name != "" {
+		return claims.Name
+	}
+	return c.Query("name")
+}
+
+// websocketPermissions returns the permissions of the access token of a
+// websocket, or those of a publisher when tokens are not required.
+func websocketPermissions(c *websocket.Conn) auth.Permissions {
+	if claims := websocketClaims(c); claims != nil {
+		return claims.Permissions()
+	}
+	return auth.RolePublisher.Permissions()
+}
+
+// grantChatRole gives the user of a websocket the chat role matching the
+// permissions of its access token, until the token expires.
+func grantChatRole(c *websocket.Conn, hub *customchat.CustomHub) {
+	claims := websocketClaims(c)
+	if claims == nil {
+		return
+	}
+
+	role := customchat.RoleMember
+	permissions := claims.Permissions()
+	switch {
+	case claims.Role == auth.RoleHost:
+		role = customchat.RoleHost
+	case permissions.Moderate:
+		role = customchat.RoleModerator
+	case !permissions.Chat:
+		role = customchat.RoleViewer
+	}
+	hub.Grant(claims.Subject, role, time.Unix(claims.ExpiresAt, 0))
+}
+
+// tokenRequest is the body of a request for an access token. The participant
+// ID is generated if empty, the role defaults to publisher and the TTL, in
+// seconds, to an hour. Permissions, if set, replace those of the role.
+type tokenRequest struct {
+	RoomID        string            `json:"roomId"`
+	ParticipantID string            `json:"participantId"`
+	Name          string            `json:"name"`
+	Role          auth.Role         `json:"role"`
+	Permissions   *auth.Permissions `json:"permissions"`
+	TTL           int               `json:"ttl"`
+}
+
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// HandleMintToken issues an access token to a backend presenting the API key.
+func (h *Handler) HandleMintToken(c *fiber.Ctx) error {
+	if h.Access.Tokens == nil || h.Access.APIKey == "" {
+		return c.Status(fiber.StatusNotFound).SendString("Not Found")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Get(apiKeyHeader)), []byte(h.Access.APIKey)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+	}
+
+	req := tokenRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	if req.Role == "" {
+		req.Role = auth.RolePublisher
+	}
+	ttl := defaultTokenTTL
+	if req.TTL != 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	if req.RoomID == "" || !req.Role.Valid() || ttl <= 0 || ttl > maxTokenTTL {
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	if req.ParticipantID == "" {
+		req.ParticipantID = gguid.New().String()
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	token, err := h.Access.Tokens.Sign(auth.Claims{
+		RoomID:    req.RoomID,
+		Subject:   req.ParticipantID,
+		Name:      req.Name,
+		Role:      req.Role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		Overrides: req.Permissions,
+	})
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
+
+	return c.JSON(tokenResponse{Token: token, ExpiresAt: expiresAt.UTC().Truncate(time.Second)})
+}
@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"errors"
+	"log"
 
 	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
 	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
@@ -10,71 +10,85 @@ import (
 )
 
 // ServeLiveChat serves the live chat room view.
-func ServeLiveChat(c *fiber.Ctx) error {
+func (h *Handler) ServeLiveChat(c *fiber.Ctx) error {
 
 	// TODO: Add the layouts
 	return c.Render("livechat", fiber.Map{}, "layouts/main")
 }
 
 // HandleStreamChatWebsocket handles WebSocket connections for stream chat.
-func HandleStreamChatWebsocket(c *websocket.Conn) {
-	streamID := c.Params("streamID")
-	if streamID == "" {
+func (h *Handler) HandleStreamChatWebsocket(c *websocket.Conn) {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+	if !ok {
 		return
 	}
-
-	stream, err := getOrCreateStream(streamID)
-	if err != nil {
-		return
-	}
-
-	// Create a new peer connection for chat
-	customchat.NewPeerChatConnection(c.Conn, stream.Hub)
+	h.chatConnection(c, stream)
 }
 
 // HandleLiveRoomChatWebsocket handles WebSocket connections for live room chat.
-func HandleLiveRoomChatWebsocket(c *websocket.Conn) {
-	roomID := c.Params("roomID")
-	if roomID == "" {
+func (h *Handler) HandleLiveRoomChatWebsocket(c *websocket.Conn) {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
 		return
 	}
+	h.chatConnection(c, room)
+}
 
-	room, err := getOrCreateRoom(roomID)
-	if err != nil {
+// chatConnection connects a chat websocket to the hub of a room. The client
+// counts as a member of the room, which stays open while people chat.
+func (h *Handler) chatConnection(c *websocket.Conn, room *webrtc.CustomRoomManager) {
+	if err := room.Join(); err != nil {
+		log.Println(err)
 		return
 	}
+	defer room.Leave()
 
-	// Create a new peer connection for chat
-	customchat.NewPeerChatConnection(c.Conn, room.Hub)
+	grantChatRole(c, room.Hub)
+	customchat.NewPeerChatConnection(c.Conn, room.Hub, h.websocketIdentity(c), websocketName(c))
 }
 
-// getOrCreateStream retrieves an existing stream or creates a new one.
-func getOrCreateStream(streamID string) (*webrtc.CustomRoomManager, error) {
-	webrtc.StreamsLock.Lock()
-	defer webrtc.StreamsLock.Unlock()
-
-	if stream, ok := webrtc.CustomStreams[streamID]; ok {
-		return stream, nil
-	}
-
-	// Create a new stream and hub
-	stream := &webrtc.CustomRoomManager{}
-	hub := customchat.NewCustomHub()
-	stream.Hub = hub
-	go hub.Start()
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 200
+)
 
-	webrtc.CustomStreams[streamID] = stream
-	return stream, nil
+// chatHistoryPage is a page of chat history. Before is the cursor of the next,
+// older page, empty when there is none.
+type chatHistoryPage struct {
+	Messages []*customchat.Message `json:"messages"`
+	Before   string                `json:"before,omitempty"`
 }
 
-// getOrCreateRoom retrieves an existing room or returns an error.
-func getOrCreateRoom(roomID string) (*webrtc.CustomRoomManager, error) {
-	webrtc.StreamsLock.Lock()
-	defer webrtc.StreamsLock.Unlock()
+// HandleRoomChatHistory returns the chat messages of a room, oldest first. The
+// page ends with the latest message, or before the message whose ID is given
+// in the before query parameter. Protected rooms, open or closed, are not
+// found by users who cannot enter them.
+func (h *Handler) HandleRoomChatHistory(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+	limit := c.QueryInt("limit", defaultHistoryPageSize)
+	if uuid == "" || limit <= 0 || limit > maxHistoryPageSize {
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	if access, ok := h.Rooms.Access(uuid); ok && h.admit(c, uuid, access) != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Room Not Found")
+	}
 
-	if room, ok := webrtc.CustomRooms[roomID]; ok {
-		return room, nil
+	page := chatHistoryPage{Messages: []*customchat.Message{}}
+	if h.Chat == nil {
+		return c.JSON(page)
 	}
 
-	return nil, errors.New("room not found")
+	messages, err := h.Chat.History(uuid, c.Query("before"), limit)
+	if err != nil {
+		log.Printf("chat history error: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
+
+	if len(messages) > 0 {
+		page.Messages = messages
+	}
+	if len(messages) == limit {
+		page.Before = messages[0].ID
+	}
+	return c.JSON(page)
 }
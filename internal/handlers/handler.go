@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
+	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
+)
+
+// Handler serves the routes of one server. Rooms are created in and looked up
+// through its registry, so several servers can run side by side.
+type Handler struct {
+	Rooms  webrtc.RoomRegistry
+	Chat   customchat.ChatStore // Chat history of the rooms, may be nil
+	Access Access
+
+	identitySecret []byte          // Signs the identity cookies
+	attempts       *attemptLimiter // Password and invite attempts of each address on each room
+	roomCreations  *attemptLimiter // Rooms created by each address
+}
+
+// New creates a Handler backed by the given room registry and chat store,
+// letting in the websockets allowed by access.
+func New(rooms webrtc.RoomRegistry, chat customchat.ChatStore, access Access) *Handler {
+	return &Handler{
+		Rooms:          rooms,
+		Chat:           chat,
+		Access:         access,
+		identitySecret: identitySecret(access.IdentitySecret),
+		attempts:       newAttemptLimiter(maxAttempts, attemptWindow),
+		roomCreations:  newAttemptLimiter(maxRoomCreations, attemptWindow),
+	}
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	gguid "github.com/google/uuid"
+)
+
+const (
+	identityCookie    = "golivesync_id"
+	identityCookieAge = 365 * 24 * time.Hour
+)
+
+// identitySecret returns the key signing identity cookies, or a random key if
+// none is configured. Cookies signed with a random key, and the room
+// ownership and admission tied to them, do not survive a restart.
+func identitySecret(configured []byte) []byte {
+	if len(configured) > 0 {
+		return configured
+	}
+
+	log.Println("No identity secret configured, identity cookies will not survive a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// identity returns the ID of the browser sending the request. A new ID is
+// issued in a signed cookie if the request has no valid one, so that users
+// cannot claim the ID of someone else, such as a room host.
+func (h *Handler) identity(c *fiber.Ctx) string {
+	if id, ok := h.verifyIdentity(c.Cookies(identityCookie)); ok {
+		return id
+	}
+
+	id := gguid.New().String()
+	c.Cookie(&fiber.Cookie{
+		Name:     identityCookie,
+		Value:    h.signIdentity(id),
+		Path:     "/",
+		Expires:  time.Now().Add(identityCookieAge),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return id
+}
+
+// websocketIdentity returns the participant ID from the access token of a
+// websocket, the ID from its identity cookie, or a new ID for this connection
+// only.
+func (h *Handler) websocketIdentity(c *websocket.Conn) string {
+	if claims := websocketClaims(c); claims != nil {
+		return claims.Subject
+	}
+	if id, ok := h.verifyIdentity(c.Cookies(identityCookie)); ok {
+		return id
+	}
+	return gguid.New().String()
+}
+
+func (h *Handler) signIdentity(id string) string {
+	mac := hmac.New(sha256.New, h.identitySecret)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Handler) verifyIdentity(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(value), []byte(h.signIdentity(id))) {
+		return "", false
+	}
+	return id, true
+}
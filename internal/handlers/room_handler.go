@@ -1,58 +1,71 @@
 package handlers
 
 import (
-	"crypto/sha256"
+	"errors"
 	"fmt"
+	"log"
 	"os"
-	"time"
 
-	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
+	"github.com/Parthiba-Hazra/golivesync/pkg/auth"
 	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	gguid "github.com/google/uuid"
-	w "github.com/pion/webrtc/v3"
 )
 
 // GenerateNewRoomUUID generates a new room UUID and redirects to the room.
-func GenerateNewRoomUUID(c *fiber.Ctx) error {
+func (h *Handler) GenerateNewRoomUUID(c *fiber.Ctx) error {
 	uuid := gguid.New().String()
 	return c.Redirect(fmt.Sprintf("/room/%s", uuid))
 }
 
-// HandleRoomWebsocket handles WebSocket connections for the room.
-func HandleRoomWebsocket(c *websocket.Conn) {
-	handleWebsocket(c, "room")
-}
-
-// HandleRoomViewerWebsocket handles WebSocket connections for room viewers.
-func HandleRoomViewerWebsocket(conn *websocket.Conn) {
-	handleWebsocket(conn, "viewer")
-}
-
-func handleWebsocket(c *websocket.Conn, streamType string) {
+// HandleRoomWebsocket handles WebSocket connections for the room, creating the
+// room if needed.
+func (h *Handler) HandleRoomWebsocket(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		return
 	}
 
-	webrtc.StreamsLock.Lock()
-	defer webrtc.StreamsLock.Unlock()
+	_, _, room, err := h.CreateOrRetrieveRoom(uuid, h.websocketOwner(c))
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	var peer *webrtc.CustomRoomManager
-	if streamType == "room" {
-		peer, _ = getOrCreateRoom(uuid)
-	} else if streamType == "viewer" {
-		peer = webrtc.CustomRooms[uuid]
+	webrtc.CustomRoomConnection(c, websocketParticipant(c), room.Peers)
+}
+
+// HandleRoomViewerWebsocket handles WebSocket connections for room viewers.
+func (h *Handler) HandleRoomViewerWebsocket(c *websocket.Conn) {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return
 	}
 
-	if peer != nil {
-		webrtc.CustomRoomConnection(c, peer.Peers)
+	webrtc.CustomRoomConnection(c, websocketParticipant(c), room.Peers)
+}
+
+// newParticipant creates a participant identified by the subject of its
+// access token, or by a random ID without one.
+func newParticipant(claims *auth.Claims, displayName string) *webrtc.Participant {
+	id := gguid.New().String()
+	if claims != nil {
+		id = claims.Subject
 	}
+	return webrtc.NewParticipant(id, displayName, nil)
+}
+
+// websocketParticipant creates the participant of a websocket, with the
+// identity, name and permissions of its access token.
+func websocketParticipant(c *websocket.Conn) *webrtc.Participant {
+	participant := newParticipant(websocketClaims(c), websocketName(c))
+	participant.Permissions = websocketPermissions(c)
+	return participant
 }
 
 // ServeRoom serves the room view.
-func ServeRoom(c *fiber.Ctx) error {
+func (h *Handler) ServeRoom(c *fiber.Ctx) error {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
@@ -63,8 +76,11 @@ func ServeRoom(c *fiber.Ctx) error {
 		wsScheme = "wss"
 	}
 
-	uuid, suuid, _ := CreateOrRetrieveRoom(uuid)
-	// (Uncomment and complete this line as needed)
+	uuid, suuid, _, err := h.CreateOrRetrieveRoom(uuid, h.requestOwner(c, uuid))
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
 
 	return c.Render("room", generateRoomRenderData(c, uuid, suuid, wsScheme))
 }
@@ -80,59 +96,95 @@ func generateRoomRenderData(c *fiber.Ctx, uuid, suuid, wsScheme string) fiber.Ma
 	}
 }
 
-func CreateOrRetrieveRoom(uuid string) (string, string, *webrtc.CustomRoomManager) {
-	webrtc.StreamsLock.Lock()
-	defer webrtc.StreamsLock.Unlock()
-
-	suuid := generateStreamUUID(uuid)
-
-	if room := webrtc.CustomRooms[uuid]; room != nil {
-		if _, ok := webrtc.CustomRooms[suuid]; !ok {
-			webrtc.CustomStreams[suuid] = room
+// CreateOrRetrieveRoom returns the room with the given UUID, creating a
+// public room if needed, or opening a closed protected room again, along
+// with its stream key. A new room, or one
+// without owner, is owned by ownerID, who hosts its chat; an empty ownerID
+// leaves the room without owner.
+func (h *Handler) CreateOrRetrieveRoom(uuid, ownerID string) (string, string, *webrtc.CustomRoomManager, error) {
+	room, ok := h.Rooms.Get(uuid)
+	if ok && room.Hub.ClaimOwner(ownerID) {
+		room.Access.Admit(ownerID)
+	}
+	if !ok {
+		var err error
+		room, err = h.createRoom(uuid, ownerID, webrtc.RoomOptions{})
+		if errors.Is(err, webrtc.ErrRoomExists) {
+			// Created concurrently by another request
+			return h.CreateOrRetrieveRoom(uuid, ownerID)
+		}
+		if err != nil {
+			return "", "", nil, err
 		}
-		return uuid, suuid, room
 	}
-
-	room := createNewRoom(uuid, suuid)
-	return uuid, suuid, room
+	return uuid, room.Access.StreamKey, room, nil
 }
 
-func generateStreamUUID(uuid string) string {
-	h := sha256.New()
-	h.Write([]byte(uuid))
-	return fmt.Sprintf("%x", h.Sum(nil))
+// requestOwner returns who owns the rooms a request creates or finds without
+// owner: the holder of a host token for the room, or, when tokens are not
+// required, the user of the identity cookie, which is issued if needed.
+func (h *Handler) requestOwner(c *fiber.Ctx, roomID string) string {
+	if claims := h.requestClaims(c); claims != nil {
+		return hostSubject(claims, roomID)
+	}
+	if h.Access.Tokens != nil {
+		return ""
+	}
+	return h.identity(c)
 }
 
-func createNewRoom(uuid, suuid string) *webrtc.CustomRoomManager {
-	hub := customchat.NewCustomHub()
-	p := &webrtc.CustomPeerManager{}
-	p.TrackLocals = make(map[string]*w.TrackLocalStaticRTP)
+// websocketOwner returns who owns the rooms a websocket creates or finds
+// without owner: the holder of a host token, or the user of a valid identity
+// cookie. Websockets without either own nothing, their identity lasts for
+// the connection only.
+func (h *Handler) websocketOwner(c *websocket.Conn) string {
+	if claims := websocketClaims(c); claims != nil {
+		return hostSubject(claims, claims.RoomID)
+	}
+	if id, ok := h.verifyIdentity(c.Cookies(identityCookie)); ok {
+		return id
+	}
+	return ""
+}
 
-	room := &webrtc.CustomRoomManager{
-		Peers: p,
-		Hub:   hub,
+// hostSubject returns the participant of a host token for the room, or an
+// empty string.
+func hostSubject(claims *auth.Claims, roomID string) string {
+	if claims == nil || claims.Role != auth.RoleHost || claims.RoomID != roomID {
+		return ""
 	}
-	webrtc.CustomRooms[uuid] = room
-	webrtc.CustomStreams[suuid] = room
-	go hub.Start()
-	return room
+	return claims.Subject
 }
 
-// HandleRoomViewerConnection handles the WebSocket connection for a room viewer.
-func HandleRoomViewerConnection(conn *websocket.Conn, peers *webrtc.CustomPeerManager) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	defer conn.Close()
+// createRoom creates a room owned by ownerID, who enters it right away, and
+// points its random stream key to it. A closed protected room opened again
+// keeps its former owner.
+func (h *Handler) createRoom(uuid, ownerID string, options webrtc.RoomOptions) (*webrtc.CustomRoomManager, error) {
+	room, err := h.Rooms.Create(uuid, options)
+	if err != nil {
+		return nil, err
+	}
 
-	for range ticker.C {
-		sendViewerConnectionCount(conn, peers)
+	if room.Hub.ClaimOwner(ownerID) {
+		room.Access.Admit(ownerID)
 	}
+	if err := h.Rooms.Alias(room.Access.StreamKey, uuid); err != nil {
+		return nil, err
+	}
+	return room, nil
 }
 
-func sendViewerConnectionCount(conn *websocket.Conn, peers *webrtc.CustomPeerManager) {
+func sendViewerConnectionCount(conn *websocket.Conn, peers *webrtc.CustomPeerManager) error {
+	peers.ListLock.RLock()
+	count := len(peers.Connections)
+	peers.ListLock.RUnlock()
+
 	w, err := conn.Conn.NextWriter(websocket.TextMessage)
 	if err != nil {
-		return
+		return err
+	}
+	if _, err := w.Write([]byte(fmt.Sprintf("%d", count))); err != nil {
+		return err
 	}
-	w.Write([]byte(fmt.Sprintf("%d", len(peers.Connections))))
+	return w.Close()
 }
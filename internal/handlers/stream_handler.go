@@ -10,8 +10,9 @@ import (
 	"github.com/gofiber/websocket/v2"
 )
 
-func ServeCustomStream(c *fiber.Ctx) error {
-	customStreamID := c.Params("streamID")
+// ServeCustomStream serves the stream view.
+func (h *Handler) ServeCustomStream(c *fiber.Ctx) error {
+	customStreamID := c.Params("ssuid")
 	if customStreamID == "" {
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
@@ -21,7 +22,7 @@ func ServeCustomStream(c *fiber.Ctx) error {
 		wsScheme = "wss"
 	}
 
-	if _, ok := webrtc.CustomStreams[customStreamID]; ok {
+	if _, ok := h.Rooms.GetAlias(customStreamID); ok {
 		return serveCustomStreamPage(c, customStreamID, wsScheme)
 	}
 
@@ -44,52 +45,40 @@ func serveNoStreamPage(c *fiber.Ctx) error {
 	}, "layouts/main")
 }
 
-func HandleCustomStreamWebsocket(c *websocket.Conn) {
-	handleCustomStreamWebsocket(c)
-}
-
-func HandleCustomStreamViewerWebsocket(c *websocket.Conn) {
-	handleCustomStreamViewerWebsocket(c)
-}
-
-func handleCustomStreamWebsocket(c *websocket.Conn) {
-	customStreamID := c.Params("customStreamID")
-	if customStreamID == "" {
-		return
-	}
-	streams, ok := getCustomStream(customStreamID)
+// HandleCustomStreamWebsocket handles WebSocket connections for the stream.
+func (h *Handler) HandleCustomStreamWebsocket(c *websocket.Conn) {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
 	if !ok {
 		return
 	}
-	webrtc.CustomStreamConnection(c, streams.Peers)
+	webrtc.CustomStreamConnection(c, websocketParticipant(c), stream.Peers)
 }
 
-func handleCustomStreamViewerWebsocket(c *websocket.Conn) {
-	customStreamID := c.Params("customStreamID")
-	if customStreamID == "" {
-		return
-	}
-	streams, ok := getCustomStream(customStreamID)
+// HandleCustomStreamViewerWebsocket sends the viewer count of the stream.
+func (h *Handler) HandleCustomStreamViewerWebsocket(c *websocket.Conn) {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
 	if !ok {
 		return
 	}
-	viewerConnection(c, streams.Peers)
-}
-
-func getCustomStream(customStreamID string) (*webrtc.CustomRoomManager, bool) {
-	webrtc.StreamsLock.Lock()
-	defer webrtc.StreamsLock.Unlock()
-
-	streams, ok := webrtc.CustomStreams[customStreamID]
-	return streams, ok
+	viewerConnection(c, stream)
 }
 
-func viewerConnection(c *websocket.Conn, p *webrtc.CustomPeerManager) {
+// viewerConnection sends the number of connected peers every second until the
+// viewer disconnects or the room closes.
+func viewerConnection(c *websocket.Conn, room *webrtc.CustomRoomManager) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 	defer c.Close()
 
-	for range ticker.C {
-		sendViewerConnectionCount(c, p)
+	for {
+		select {
+		case <-ticker.C:
+			if err := sendViewerConnectionCount(c, room.Peers); err != nil {
+				return
+			}
+		case <-room.Done():
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "room closed"))
+			return
+		}
 	}
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleStreamWHEP accepts a WHEP playback request for a stream, unless its
+// access token does not allow subscribing.
+func (h *Handler) HandleStreamWHEP(c *fiber.Ctx) error {
+	ssuid := c.Params("ssuid")
+	stream, ok := h.Rooms.GetAlias(ssuid)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Stream Not Found")
+	}
+	if claims := h.requestClaims(c); claims != nil && !claims.Permissions().Subscribe {
+		return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+	}
+
+	offer, err := readSDPOffer(c)
+	if err != nil {
+		return err
+	}
+
+	sessionID, answer, err := webrtc.CustomWHEPConnection(offer, stream.Peers)
+	switch {
+	case errors.Is(err, webrtc.ErrNoTracks):
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Stream Not Live")
+	case err != nil:
+		log.Printf("whep negotiation error: %v", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	admitSession(stream, sessionID)
+
+	return sendSDPAnswer(c, fmt.Sprintf("/stream/%s/whep/%s", ssuid, sessionID), answer)
+}
+
+// HandleStreamWHEPPatch applies trickle ICE candidates to a WHEP session.
+func (h *Handler) HandleStreamWHEPPatch(c *fiber.Ctx) error {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Stream Not Found")
+	}
+	return handleSessionPatch(c, stream.Peers)
+}
+
+// HandleStreamWHEPDelete tears down a WHEP session.
+func (h *Handler) HandleStreamWHEPDelete(c *fiber.Ctx) error {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Stream Not Found")
+	}
+	return handleSessionDelete(c, stream.Peers)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	sdpContentType        = "application/sdp"
+	trickleICEContentType = "application/trickle-ice-sdpfrag"
+)
+
+// HandleRoomWHIP accepts a WHIP publish request for a room, creating the room if needed.
+func (h *Handler) HandleRoomWHIP(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+	if uuid == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	participant, err := h.whipParticipant(c)
+	if err != nil {
+		return err
+	}
+
+	_, _, room, err := h.CreateOrRetrieveRoom(uuid, hostSubject(h.requestClaims(c), uuid))
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+	}
+	return handleWHIPOffer(c, participant, room, fmt.Sprintf("/room/%s/whip", uuid))
+}
+
+// HandleRoomWHIPPatch applies trickle ICE candidates to a room WHIP session.
+func (h *Handler) HandleRoomWHIPPatch(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Room Not Found")
+	}
+	return handleSessionPatch(c, room.Peers)
+}
+
+// HandleRoomWHIPDelete tears down a room WHIP session.
+func (h *Handler) HandleRoomWHIPDelete(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Room Not Found")
+	}
+	return handleSessionDelete(c, room.Peers)
+}
+
+// HandleStreamWHIP accepts a WHIP publish request for an existing stream.
+func (h *Handler) HandleStreamWHIP(c *fiber.Ctx) error {
+	ssuid := c.Params("ssuid")
+	stream, ok := h.Rooms.GetAlias(ssuid)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Stream Not Found")
+	}
+
+	participant, err := h.whipParticipant(c)
+	if err != nil {
+		return err
+	}
+	return handleWHIPOffer(c, participant, stream, fmt.Sprintf("/stream/%s/whip", ssuid))
+}
+
+// HandleStreamWHIPPatch applies trickle ICE candidates to a stream WHIP session.
+func (h *Handler) HandleStreamWHIPPatch(c *fiber.Ctx) error {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Stream Not Found")
+	}
+	return handleSessionPatch(c, stream.Peers)
+}
+
+// HandleStreamWHIPDelete tears down a stream WHIP session.
+func (h *Handler) HandleStreamWHIPDelete(c *fiber.Ctx) error {
+	stream, ok := h.Rooms.GetAlias(c.Params("ssuid"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Stream Not Found")
+	}
+	return handleSessionDelete(c, stream.Peers)
+}
+
+// whipParticipant creates the participant of a WHIP request, with the
+// identity, name and permissions of its access token. It fails if the token does not allow
+// publishing.
+func (h *Handler) whipParticipant(c *fiber.Ctx) (*webrtc.Participant, error) {
+	claims := h.requestClaims(c)
+	participant := newParticipant(claims, c.Query("name"))
+	if claims != nil {
+		if claims.Name != "" {
+			participant.DisplayName = claims.Name
+		}
+		participant.Permissions = claims.Permissions()
+	}
+
+	if !participant.Permissions.CanPublish() {
+		return nil, fiber.NewError(fiber.StatusForbidden, "Forbidden")
+	}
+	return participant, nil
+}
+
+func handleWHIPOffer(c *fiber.Ctx, participant *webrtc.Participant, room *webrtc.CustomRoomManager, resourcePath string) error {
+	offer, err := readSDPOffer(c)
+	if err != nil {
+		return err
+	}
+
+	sessionID, answer, err := webrtc.CustomWHIPConnection(offer, participant, room.Peers)
+	if errors.Is(err, webrtc.ErrParticipantExists) {
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	}
+	if err != nil {
+		log.Printf("whip negotiation error: %v", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	admitSession(room, sessionID)
+
+	return sendSDPAnswer(c, fmt.Sprintf("%s/%s", resourcePath, sessionID), answer)
+}
+
+// admitSession lets a WHIP or WHEP session into its room, so that changing
+// it does not need the password or an invite again.
+func admitSession(room *webrtc.CustomRoomManager, sessionID string) {
+	if room.Access.Protected() {
+		room.Access.Admit(sessionID)
+	}
+}
+
+// readSDPOffer validates the body of a WHIP/WHEP request and returns the offer.
+func readSDPOffer(c *fiber.Ctx) (string, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), sdpContentType) {
+		return "", fiber.NewError(fiber.StatusUnsupportedMediaType, "Unsupported Media Type")
+	}
+
+	offer := string(c.Body())
+	if strings.TrimSpace(offer) == "" {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Bad Request")
+	}
+	return offer, nil
+}
+
+func sendSDPAnswer(c *fiber.Ctx, location, answer string) error {
+	c.Set(fiber.HeaderLocation, location)
+	c.Set(fiber.HeaderContentType, sdpContentType)
+	return c.Status(fiber.StatusCreated).SendString(answer)
+}
+
+func handleSessionPatch(c *fiber.Ctx, peers *webrtc.CustomPeerManager) error {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), trickleICEContentType) {
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Unsupported Media Type")
+	}
+
+	err := peers.PatchCustomSession(c.Params("sessionID"), string(c.Body()))
+	switch {
+	case errors.Is(err, webrtc.ErrSessionNotFound):
+		return c.Status(fiber.StatusNotFound).SendString("Session Not Found")
+	case err != nil:
+		log.Printf("trickle ice error: %v", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func handleSessionDelete(c *fiber.Ctx, peers *webrtc.CustomPeerManager) error {
+	err := peers.CloseCustomSession(c.Params("sessionID"))
+	switch {
+	case errors.Is(err, webrtc.ErrSessionNotFound):
+		return c.Status(fiber.StatusNotFound).SendString("Session Not Found")
+	case err != nil:
+		log.Printf("session teardown error: %v", err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"errors"
 	"flag"
+	"log"
 	"os"
 	"time"
 
 	"github.com/Parthiba-Hazra/golivesync/internal/handlers"
+	"github.com/Parthiba-Hazra/golivesync/pkg/auth"
+	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
+	"github.com/Parthiba-Hazra/golivesync/pkg/events"
+	"github.com/Parthiba-Hazra/golivesync/pkg/webhook"
 	"github.com/Parthiba-Hazra/golivesync/pkg/webrtc"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -23,6 +29,20 @@ func StartServer() error {
 	port := flag.String("port", ":"+os.Getenv("PORT"), "Port for the server")
 	cert := flag.String("cert", "", "Path to SSL certificate")
 	key := flag.String("key", "", "Path to SSL key")
+	chatDB := flag.String("chat-db", "", "Path to the database file storing chat history, kept in memory if empty")
+	roomIdleTimeout := flag.Duration("room-idle-timeout", webrtc.DefaultRoomIdleTimeout, "How long a room without peers is kept before it is closed")
+	chatRate := flag.Float64("chat-rate", customchat.DefaultFloodPolicy.Client.Rate, "Chat messages per second a client may send, 0 for no limit")
+	chatBurst := flag.Int("chat-burst", customchat.DefaultFloodPolicy.Client.Burst, "Chat messages a client may send in a burst")
+	roomChatRate := flag.Float64("room-chat-rate", customchat.DefaultFloodPolicy.Room.Rate, "Chat messages per second a room accepts, 0 for no limit")
+	roomChatBurst := flag.Int("room-chat-burst", customchat.DefaultFloodPolicy.Room.Burst, "Chat messages a room accepts in a burst")
+	slowConsumer := flag.String("chat-slow-consumer", customchat.SlowConsumerDropOldest.String(), "What happens to chat clients that do not keep up: drop-oldest, drop-newest or disconnect")
+	webhookURL := flag.String("webhook-url", "", "URL receiving the room, participant, track and chat events, none are sent if empty")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("WEBHOOK_SECRET"), "Secret signing the webhook requests")
+	logEvents := flag.Bool("log-events", false, "Log the room, participant, track and chat events")
+	authSecret := flag.String("auth-secret", os.Getenv("AUTH_SECRET"), "Secret of the HS256 access tokens required on the websockets, WHIP, WHEP and chat history, none are required if empty")
+	authKey := flag.String("auth-key", "", "PEM file of the Ed25519 private key, or public key, of EdDSA access tokens, instead of -auth-secret")
+	apiKey := flag.String("api-key", os.Getenv("API_KEY"), "API key of the token endpoint, which is disabled if empty")
+	identitySecret := flag.String("identity-secret", os.Getenv("IDENTITY_SECRET"), "Secret signing the identity cookies, random for each run if empty")
 	flag.Parse()
 
 	// Set default port if not provided
@@ -30,6 +50,79 @@ func StartServer() error {
 		*port = defaultPort
 	}
 
+	slowConsumerPolicy, err := customchat.ParseSlowConsumerPolicy(*slowConsumer)
+	if err != nil {
+		return err
+	}
+
+	var chat customchat.ChatStore = customchat.NewMemoryChatStore(0)
+	if *chatDB != "" {
+		store, err := customchat.OpenBoltChatStore(*chatDB)
+		if err != nil {
+			return err
+		}
+		chat = store
+	}
+	defer chat.Close()
+
+	access := handlers.Access{APIKey: *apiKey, IdentitySecret: []byte(*identitySecret)}
+	switch {
+	case *authKey != "":
+		pemKey, err := os.ReadFile(*authKey)
+		if err != nil {
+			return err
+		}
+		if access.Tokens, err = auth.ParseEd25519PEM(pemKey); err != nil {
+			return err
+		}
+	case *authSecret != "":
+		access.Tokens = auth.NewHMACKeys([]byte(*authSecret))
+	}
+
+	bus := events.NewBus()
+	if *webhookURL != "" {
+		if *webhookSecret == "" {
+			return errors.New("a webhook secret is required with a webhook URL")
+		}
+		webhooks := webhook.NewDispatcher(bus, *webhookURL, *webhookSecret)
+		webhooks.Start()
+		defer webhooks.Close()
+	}
+	if *logEvents {
+		go logBusEvents(bus.Subscribe(events.Filter{}, 0))
+	}
+
+	flood := customchat.DefaultFloodPolicy
+	flood.Client = customchat.RateLimit{Rate: *chatRate, Burst: *chatBurst}
+	flood.Room = customchat.RateLimit{Rate: *roomChatRate, Burst: *roomChatBurst}
+
+	app := New(webrtc.NewMemoryRoomRegistry(webrtc.RoomConfig{
+		IdleTimeout:      *roomIdleTimeout,
+		ChatStore:        chat,
+		ChatFlood:        &flood,
+		ChatSlowConsumer: slowConsumerPolicy,
+		Events:           bus,
+	}), chat, access)
+
+	// Listen for incoming connections
+	if *cert != "" {
+		return app.ListenTLS(*port, *cert, *key)
+	}
+
+	return app.Listen(*port)
+}
+
+// logBusEvents logs the events of a subscription until it ends.
+func logBusEvents(subscription *events.Subscription) {
+	for event := range subscription.Events() {
+		log.Printf("event %s in room %s: %+v", event.Type, event.RoomID, event.Data)
+	}
+}
+
+// New creates the Fiber app of a server whose rooms live in the given
+// registry. The chat store serves the chat history of the rooms, access
+// configures who may use the websockets.
+func New(rooms webrtc.RoomRegistry, chat customchat.ChatStore, access handlers.Access) *fiber.App {
 	// TODO: add the view folder and necessary HTML files
 	// Create HTML template engine TODO: front end is not created yet
 	engine := html.New("./frontEnd/views", ".html")
@@ -41,51 +134,54 @@ func StartServer() error {
 
 	// Middleware
 	app.Use(logger.New())
-	app.Use(cors.New())
+	app.Use(cors.New(cors.Config{
+		ExposeHeaders: fiber.HeaderLocation,
+	}))
 
 	// Define routes and WebSocket handlers
-	defineRoutes(app)
-
-	// Initialize the Custom WebRTC Rooms and Streams
-	webrtc.CustomRooms = make(map[string]*webrtc.CustomRoomManager)
-	webrtc.CustomStreams = make(map[string]*webrtc.CustomRoomManager)
+	defineRoutes(app, handlers.New(rooms, chat, access))
 
-	// Launch the routine to dispatch key frames
-	go customDispatchKeyFrames()
-
-	// Listen for incoming connections
-	if *cert != "" {
-		return app.ListenTLS(*port, *cert, *key)
-	}
-
-	return app.Listen(*port)
+	return app
 }
 
-func defineRoutes(app *fiber.App) {
+func defineRoutes(app *fiber.App, h *handlers.Handler) {
+	// Access tokens
+	app.Post("/auth/token", h.HandleMintToken)
+
 	// Room routes
-	app.Get("/room/create", handlers.GenerateNewRoomUUID)
-	app.Get("/room/:uuid", handlers.ServeRoom)
-	app.Get("/room/:uuid/websocket", websocket.New(handlers.HandleRoomWebsocket, websocket.Config{
+	app.Get("/room/create", h.GenerateNewRoomUUID)
+	app.Post("/room/create", h.LimitRoomCreation, h.HandleCreateRoom)
+	app.Post("/room/:uuid/join", h.HandleJoinRoom)
+	app.Post("/room/:uuid/invites", h.HandleCreateInvite)
+	app.Get("/room/:uuid", h.RequireAdmission, h.LimitRoomCreation, h.ServeRoom)
+	app.Get("/room/:uuid/websocket", h.RequireToken(auth.RoleViewer), h.RequireAdmission, h.LimitRoomCreation, websocket.New(h.HandleRoomWebsocket, websocket.Config{
 		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     webrtc.SignalingSubprotocols,
 	}))
 
+	// WHIP ingest routes
+	app.Post("/room/:uuid/whip", h.RequireToken(auth.RolePublisher), h.RequireAdmission, h.LimitRoomCreation, h.HandleRoomWHIP)
+	app.Patch("/room/:uuid/whip/:sessionID", h.RequireToken(auth.RolePublisher), h.RequireAdmission, h.HandleRoomWHIPPatch)
+	app.Delete("/room/:uuid/whip/:sessionID", h.RequireToken(auth.RolePublisher), h.RequireAdmission, h.HandleRoomWHIPDelete)
+
 	// Chat routes
-	app.Get("/room/:uuid/chat", handlers.ServeLiveChat)
-	app.Get("/room/:uuid/chat/websocket", websocket.New(handlers.HandleLiveRoomChatWebsocket))
-	app.Get("/room/:uuid/viewer/websocket", websocket.New(handlers.HandleRoomViewerWebsocket))
+	app.Get("/room/:uuid/chat", h.RequireAdmission, h.ServeLiveChat)
+	app.Get("/room/:uuid/chat/history", h.RequireToken(auth.RoleViewer), h.HandleRoomChatHistory)
+	app.Get("/room/:uuid/chat/websocket", h.RequireToken(auth.RoleViewer), h.RequireAdmission, websocket.New(h.HandleLiveRoomChatWebsocket))
+	app.Get("/room/:uuid/viewer/websocket", h.RequireToken(auth.RoleViewer), h.RequireAdmission, websocket.New(h.HandleRoomViewerWebsocket))
 
 	// Stream routes
-	app.Get("/stream/:ssuid", handlers.ServeCustomStream)
-	app.Get("/stream/:ssuid/websocket", websocket.New(handlers.HandleCustomStreamWebsocket, websocket.Config{HandshakeTimeout: 10 * time.Second}))
-	app.Get("/stream/:ssuid/chat/websocket", websocket.New(handlers.HandleStreamChatWebsocket))
-	app.Get("/stream/:ssuid/viewer/websocket", websocket.New(handlers.HandleCustomStreamViewerWebsocket))
-}
-
-// customDispatchKeyFrames periodically sends key frames to connected peers.
-func customDispatchKeyFrames() {
-	for range time.NewTicker(time.Second * 3).C {
-		for _, room := range webrtc.CustomRooms {
-			room.Peers.DispatchCustomKeyFrame()
-		}
-	}
+	app.Get("/stream/:ssuid", h.RequireAdmission, h.ServeCustomStream)
+	app.Get("/stream/:ssuid/websocket", h.RequireToken(auth.RoleViewer), h.RequireAdmission, websocket.New(h.HandleCustomStreamWebsocket, websocket.Config{
+		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     webrtc.SignalingSubprotocols,
+	}))
+	app.Get("/stream/:ssuid/chat/websocket", h.RequireToken(auth.RoleViewer), h.RequireAdmission, websocket.New(h.HandleStreamChatWebsocket))
+	app.Get("/stream/:ssuid/viewer/websocket", h.RequireToken(auth.RoleViewer), h.RequireAdmission, websocket.New(h.HandleCustomStreamViewerWebsocket))
+	app.Post("/stream/:ssuid/whip", h.RequireToken(auth.RolePublisher), h.RequireAdmission, h.HandleStreamWHIP)
+	app.Patch("/stream/:ssuid/whip/:sessionID", h.RequireToken(auth.RolePublisher), h.RequireAdmission, h.HandleStreamWHIPPatch)
+	app.Delete("/stream/:ssuid/whip/:sessionID", h.RequireToken(auth.RolePublisher), h.RequireAdmission, h.HandleStreamWHIPDelete)
+	app.Post("/stream/:ssuid/whep", h.RequireToken(auth.RoleViewer), h.RequireAdmission, h.HandleStreamWHEP)
+	app.Patch("/stream/:ssuid/whep/:sessionID", h.RequireToken(auth.RoleViewer), h.RequireAdmission, h.HandleStreamWHEPPatch)
+	app.Delete("/stream/:ssuid/whep/:sessionID", h.RequireToken(auth.RoleViewer), h.RequireAdmission, h.HandleStreamWHEPDelete)
 }
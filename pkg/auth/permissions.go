@@ -0,0 +1,29 @@
+package auth
+
+// Permissions are what a participant may do in a room.
+type Permissions struct {
+	PublishAudio  bool `json:"publishAudio"`
+	PublishVideo  bool `json:"publishVideo"`  // Camera video
+	PublishScreen bool `json:"publishScreen"` // Video the client declares as a screen share
+	Subscribe     bool `json:"subscribe"`     // Receive the tracks of the others
+	Chat          bool `json:"chat"`          // Send chat messages
+	Moderate      bool `json:"moderate"`      // Mute, kick and ban in the chat
+}
+
+// CanPublish reports whether any kind of track may be published.
+func (p Permissions) CanPublish() bool {
+	return p.PublishAudio || p.PublishVideo || p.PublishScreen
+}
+
+// Permissions returns the permissions granted by the role.
+func (r Role) Permissions() Permissions {
+	switch r {
+	case RoleViewer:
+		return Permissions{Subscribe: true, Chat: true}
+	case RolePublisher, RoleMember:
+		return Permissions{PublishAudio: true, PublishVideo: true, PublishScreen: true, Subscribe: true, Chat: true}
+	case RoleModerator, RoleHost:
+		return Permissions{PublishAudio: true, PublishVideo: true, PublishScreen: true, Subscribe: true, Chat: true, Moderate: true}
+	}
+	return Permissions{}
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role is what the holder of a token may do in a room, see Permissions.
+type Role string
+
+const (
+	RoleViewer    Role = "viewer"    // Watches the room and uses the chat
+	RolePublisher Role = "publisher" // Also publishes audio and video
+	RoleModerator Role = "moderator" // Also moderates the chat
+	RoleHost      Role = "host"      // Owns the room
+
+	// RoleMember is the former name of RolePublisher, still accepted in
+	// tokens.
+	RoleMember Role = "member"
+)
+
+var roleRanks = map[Role]int{RoleViewer: 1, RolePublisher: 2, RoleMember: 2, RoleModerator: 3, RoleHost: 4}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	return roleRanks[r] > 0
+}
+
+// AtLeast reports whether r grants everything other grants.
+func (r Role) AtLeast(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+// Claims are the contents of an access token.
+type Claims struct {
+	RoomID    string `json:"room"`
+	Subject   string `json:"sub"` // Identity of the participant
+	Name      string `json:"name,omitempty"`
+	Role      Role   `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+
+	// Overrides replaces the permissions of the role when set.
+	Overrides *Permissions `json:"permissions,omitempty"`
+}
+
+// Permissions returns what the holder of the token may do.
+func (c *Claims) Permissions() Permissions {
+	if c.Overrides != nil {
+		return *c.Overrides
+	}
+	return c.Role.Permissions()
+}
+
+// Keys sign and verify access tokens, which are JWTs signed with HS256 or
+// EdDSA (Ed25519).
+type Keys struct {
+	algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey // Nil for keys that only verify
+	publicKey  ed25519.PublicKey
+}
+
+const (
+	algorithmHS256 = "HS256"
+	algorithmEdDSA = "EdDSA"
+)
+
+// NewHMACKeys creates keys signing with HMAC-SHA256 and a shared secret.
+func NewHMACKeys(secret []byte) *Keys {
+	return &Keys{algorithm: algorithmHS256, secret: secret}
+}
+
+// NewEd25519Keys creates keys signing with an Ed25519 private key.
+func NewEd25519Keys(privateKey ed25519.PrivateKey) *Keys {
+	return &Keys{
+		algorithm:  algorithmEdDSA,
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+}
+
+// NewEd25519VerifyKeys creates keys verifying tokens signed elsewhere with
+// the private key of publicKey. They cannot sign tokens.
+func NewEd25519VerifyKeys(publicKey ed25519.PublicKey) *Keys {
+	return &Keys{algorithm: algorithmEdDSA, publicKey: publicKey}
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// Sign returns a token carrying the claims.
+func (k *Keys) Sign(claims Claims) (string, error) {
+	if k.algorithm == algorithmEdDSA && k.privateKey == nil {
+		return "", errors.New("keys cannot sign tokens")
+	}
+
+	rawHeader, err := json.Marshal(header{Algorithm: k.algorithm, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encode(rawHeader) + "." + encode(rawClaims)
+	return signed + "." + encode(k.signature([]byte(signed))), nil
+}
+
+// Verify checks the signature and the expiry of a token and returns its
+// claims.
+func (k *Keys) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil || h.Algorithm != k.algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !k.verifySignature([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &Claims{}
+	if err := decodeJSON(parts[1], claims); err != nil || claims.RoomID == "" || claims.Subject == "" || !claims.Role.Valid() {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func (k *Keys) signature(signed []byte) []byte {
+	if k.algorithm == algorithmEdDSA {
+		return ed25519.Sign(k.privateKey, signed)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+func (k *Keys) verifySignature(signed, signature []byte) bool {
+	if k.algorithm == algorithmEdDSA {
+		return ed25519.Verify(k.publicKey, signed, signature)
+	}
+	return hmac.Equal(signature, k.signature(signed))
+}
+
+func encode(raw []byte) string {
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// ParseEd25519PEM creates keys from a PEM encoded Ed25519 private key
+// (PKCS #8), or from a public key (PKIX) for keys that only verify.
+func ParseEd25519PEM(data []byte) (*Keys, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 private key")
+		}
+		return NewEd25519Keys(privateKey), nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 public key")
+		}
+		return NewEd25519VerifyKeys(publicKey), nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
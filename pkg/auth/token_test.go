@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validClaims() Claims {
+	now := time.Now()
+	return Claims{
+		RoomID:    "room",
+		Subject:   "alice",
+		Role:      RolePublisher,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+}
+
+// unsignedToken returns a token with the given header and claims and a
+// garbage signature.
+func unsignedToken(t *testing.T, h header, claims interface{}) string {
+	t.Helper()
+
+	rawHeader, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encode(rawHeader) + "." + encode(rawClaims) + "." + encode([]byte("signature"))
+}
+
+func TestVerify(t *testing.T) {
+	keys := NewHMACKeys([]byte("secret"))
+
+	sign := func(update func(*Claims)) func(t *testing.T) string {
+		return func(t *testing.T) string {
+			claims := validClaims()
+			update(&claims)
+			token, err := keys.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}
+	}
+
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+		err   error
+	}{
+		{
+			name:  "valid",
+			token: sign(func(*Claims) {}),
+		},
+		{
+			name:  "member alias",
+			token: sign(func(c *Claims) { c.Role = RoleMember }),
+		},
+		{
+			name:  "malformed",
+			token: func(*testing.T) string { return "not.a-token" },
+			err:   ErrInvalidToken,
+		},
+		{
+			name: "other algorithm",
+			token: func(t *testing.T) string {
+				token, err := NewEd25519Keys(edPrivate).Sign(validClaims())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "none algorithm",
+			token: func(t *testing.T) string {
+				token := unsignedToken(t, header{Algorithm: "none", Type: "JWT"}, validClaims())
+				return token[:strings.LastIndex(token, ".")+1]
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "tampered claims",
+			token: func(t *testing.T) string {
+				parts := strings.Split(sign(func(*Claims) {})(t), ".")
+				claims := validClaims()
+				claims.Role = RoleHost
+				raw, err := json.Marshal(claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return parts[0] + "." + encode(raw) + "." + parts[2]
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "tampered signature",
+			token: func(t *testing.T) string {
+				token := sign(func(*Claims) {})(t)
+				signature, err := base64.RawURLEncoding.DecodeString(token[strings.LastIndex(token, ".")+1:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				signature[0] ^= 1
+				return token[:strings.LastIndex(token, ".")+1] + encode(signature)
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "signed with another secret",
+			token: func(t *testing.T) string {
+				token, err := NewHMACKeys([]byte("other")).Sign(validClaims())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name:  "missing expiry",
+			token: sign(func(c *Claims) { c.ExpiresAt = 0 }),
+			err:   ErrExpiredToken,
+		},
+		{
+			name:  "expired",
+			token: sign(func(c *Claims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() }),
+			err:   ErrExpiredToken,
+		},
+		{
+			name:  "unknown role",
+			token: sign(func(c *Claims) { c.Role = "admin" }),
+			err:   ErrInvalidToken,
+		},
+		{
+			name:  "missing role",
+			token: sign(func(c *Claims) { c.Role = "" }),
+			err:   ErrInvalidToken,
+		},
+		{
+			name:  "missing room",
+			token: sign(func(c *Claims) { c.RoomID = "" }),
+			err:   ErrInvalidToken,
+		},
+		{
+			name:  "missing subject",
+			token: sign(func(c *Claims) { c.Subject = "" }),
+			err:   ErrInvalidToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := keys.Verify(test.token(t))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Verify() error = %v, want %v", err, test.err)
+			}
+			if test.err == nil && (claims == nil || claims.Subject != "alice") {
+				t.Fatalf("Verify() claims = %+v, want the signed claims", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewEd25519Keys(privateKey).Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewEd25519VerifyKeys(publicKey).Verify(token); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if _, err := NewHMACKeys([]byte("secret")).Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("HMAC Verify() of an EdDSA token error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEd25519VerifyKeys(otherKey).Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verify() with another key error = %v, want %v", err, ErrInvalidToken)
+	}
+}
@@ -1,7 +1,6 @@
 package customchat
 
 import (
-	"bytes"
 	"log"
 	"time"
 
@@ -10,9 +9,16 @@ import (
 
 // CustomClient represents a connected client.
 type CustomClient struct {
-	Hub  *CustomHub
-	Conn *websocket.Conn
-	Send chan []byte
+	ID          string
+	DisplayName string
+	Hub         *CustomHub
+	Conn        *websocket.Conn
+	Send        chan []byte // JSON encoded messages
+
+	// Only used by the event loop of the hub
+	closed      bool
+	closeReason string // Set when Send is closed to remove the client
+	flood       *floodState
 }
 
 const (
@@ -20,13 +26,20 @@ const (
 	pingInterval   = (pongInterval * 9) / 10
 	pongInterval   = 40 * time.Second
 	maxMessageSize = 512
-)
 
-var (
-	newLine = []byte("\n")
-	space   = []byte(" ")
+	// DefaultQueueSize is how many messages are buffered for a client before
+	// the slow consumer policy of the hub applies.
+	DefaultQueueSize = 16
 )
 
+// name returns how the client is referred to in system messages.
+func (c *CustomClient) name() string {
+	if c.DisplayName != "" {
+		return c.DisplayName
+	}
+	return "anonymous"
+}
+
 func (c *CustomClient) handlePong() {
 	c.Conn.SetReadDeadline(time.Now().Add(pongInterval))
 	c.Conn.SetPongHandler(func(string) error {
@@ -37,7 +50,7 @@ func (c *CustomClient) handlePong() {
 
 func (c *CustomClient) readLoop() {
 	defer func() {
-		c.Hub.Unregister <- c
+		c.Hub.unregister(c)
 		c.Conn.Close()
 	}()
 
@@ -53,82 +66,105 @@ func (c *CustomClient) readLoop() {
 			break
 		}
 
-		message = bytes.TrimSpace(bytes.Replace(message, newLine, space, -1))
-		c.Hub.Broadcast <- message
+		parsed, ok := parseClientMessage(message)
+		c.Hub.receive(c, parsed, ok)
 	}
 }
 
-func (c *CustomClient) sendPing(pingTicker *time.Ticker) {
-	c.Conn.SetWriteDeadline(time.Now().Add(writeInterval))
-	if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+// closeSend closes the send queue of the client, which makes the write loop
+// close the websocket with the given reason. Closing it again does nothing.
+func (c *CustomClient) closeSend(reason string) {
+	if c.closed {
 		return
 	}
+	c.closed = true
+	c.closeReason = reason
+	close(c.Send)
 }
 
-func (c *CustomClient) writeLoop(pingTicker *time.Ticker) {
+func (c *CustomClient) sendPing() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeInterval))
+	return c.Conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+// writeLoop writes the queued messages and pings the client until the hub
+// closes the queue or a write fails.
+func (c *CustomClient) writeLoop() {
+	pingTicker := time.NewTicker(pingInterval)
 	defer func() {
 		pingTicker.Stop()
 		c.Conn.Close()
 	}()
 
-	c.writeMessages(pingTicker)
-}
-
-func (c *CustomClient) writeMessages(pingTicker *time.Ticker) {
 	for {
 		select {
 		case message, ok := <-c.Send:
 			if !ok {
+				c.writeClose()
+				return
+			}
+			if err := c.writeMessage(message); err != nil {
 				return
 			}
-			c.writeMessageAndHandleMore(c.Conn, message)
 		case <-pingTicker.C:
-			c.sendPing(pingTicker)
+			if err := c.sendPing(); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func (c *CustomClient) writeMessageAndHandleMore(conn *websocket.Conn, message []byte) {
-	conn.SetWriteDeadline(time.Now().Add(writeInterval))
-	writer, err := conn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		return
-	}
-	defer writer.Close()
-
-	writer.Write(message)
-
-	for {
+// writeClose tells the client why it is disconnected when it was removed by
+// the hub or the hub was stopped.
+func (c *CustomClient) writeClose() {
+	code, reason := websocket.ClosePolicyViolation, c.closeReason
+	if reason == "" {
 		select {
-		case message, ok := <-c.Send:
-			if !ok {
-				return
-			}
-			writer.Write(newLine)
-			writer.Write(message)
+		case <-c.Hub.Done():
+			code, reason = websocket.CloseGoingAway, c.Hub.closeReason
 		default:
 			return
 		}
 	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(writeInterval))
+	c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+// writeMessage sends one JSON message per websocket frame.
+func (c *CustomClient) writeMessage(message []byte) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeInterval))
+	return c.Conn.WriteMessage(websocket.TextMessage, message)
 }
 
-// NewCustomClient creates a new CustomClient instance.
-func NewCustomClient(hub *CustomHub, conn *websocket.Conn) *CustomClient {
+// NewCustomClient creates a new CustomClient instance for the identity the
+// server assigned to the connection.
+func NewCustomClient(hub *CustomHub, conn *websocket.Conn, id, displayName string) *CustomClient {
 	return &CustomClient{
-		Hub:  hub,
-		Conn: conn,
-		Send: make(chan []byte),
+		ID:          id,
+		DisplayName: displayName,
+		Hub:         hub,
+		Conn:        conn,
+		Send:        make(chan []byte, hub.QueueSize+hub.HistorySize),
 	}
 }
 
-// NewPeerChatConnection creates a new PeerChatConnection instance and starts communication goroutines.
-func NewPeerChatConnection(conn *websocket.Conn, hub *CustomHub) {
-	client := NewCustomClient(hub, conn)
-	client.Hub.Register <- client
+// NewPeerChatConnection joins a websocket to the chat of a hub and serves it
+// until it is closed, either by the client or by the hub.
+func NewPeerChatConnection(conn *websocket.Conn, hub *CustomHub, id, displayName string) {
+	client := NewCustomClient(hub, conn, id, displayName)
+	if !client.Hub.register(client) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, hub.closeReason))
+		conn.Close()
+		return
+	}
 
-	pingTicker := time.NewTicker(pingInterval)
-	defer pingTicker.Stop()
+	written := make(chan struct{})
+	go func() {
+		client.writeLoop()
+		close(written)
+	}()
 
-	go client.writeLoop(pingTicker)
-	go client.readLoop()
+	client.readLoop()
+	<-written
 }
@@ -0,0 +1,339 @@
+package customchat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CommandHandler handles a slash command sent in the chat, such as
+// "/topic Q&A". Handlers run on the event loop of the hub and must not block.
+// A returned error is sent to the sender of the command.
+type CommandHandler interface {
+	HandleCommand(command *Command) error
+}
+
+// CommandHandlerFunc adapts a function to a CommandHandler.
+type CommandHandlerFunc func(command *Command) error
+
+func (f CommandHandlerFunc) HandleCommand(command *Command) error {
+	return f(command)
+}
+
+// Command is a slash command sent by a client.
+type Command struct {
+	Name string // Name of the command, without the slash
+	Args string // Text following the name
+
+	hub    *CustomHub
+	client *CustomClient
+}
+
+// SenderID returns the user ID of the sender of the command.
+func (c *Command) SenderID() string {
+	return c.client.ID
+}
+
+// SenderName returns the display name of the sender of the command.
+func (c *Command) SenderName() string {
+	return c.client.name()
+}
+
+// Role returns the role of the sender of the command.
+func (c *Command) Role() Role {
+	return c.hub.Role(c.client.ID)
+}
+
+// Reply sends a system message to the connection the command came from only.
+func (c *Command) Reply(text string) {
+	c.hub.sendTo(c.client, c.hub.newMessage(MessageSystem, text))
+}
+
+// Broadcast sends a system message to the whole room and stores it.
+func (c *Command) Broadcast(text string) {
+	c.hub.publishMessage(c.hub.newMessage(MessageSystem, text))
+}
+
+// commands are the slash commands of a hub, keyed by name.
+type commands struct {
+	mu       sync.RWMutex
+	handlers map[string]registeredCommand
+}
+
+type registeredCommand struct {
+	usage   string
+	handler CommandHandler
+}
+
+// HandleCommand registers the handler of a slash command, replacing any
+// handler of the same name. The usage is shown by /help.
+func (h *CustomHub) HandleCommand(name, usage string, handler CommandHandler) {
+	h.commands.mu.Lock()
+	defer h.commands.mu.Unlock()
+
+	h.commands.handlers[strings.ToLower(name)] = registeredCommand{usage: usage, handler: handler}
+}
+
+// isCommand reports whether a text message is a slash command. Texts
+// starting with "//" are messages starting with a slash.
+func isCommand(text string) bool {
+	return strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//")
+}
+
+// runCommand parses a slash command sent by a client and runs its handler.
+func (h *CustomHub) runCommand(client *CustomClient, text string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(text, "/"), " ")
+	name = strings.ToLower(name)
+
+	h.commands.mu.RLock()
+	command, ok := h.commands.handlers[name]
+	h.commands.mu.RUnlock()
+	if !ok {
+		h.sendError(client, ErrorInvalid, fmt.Sprintf("unknown command /%s, see /help", name))
+		return
+	}
+
+	err := command.handler.HandleCommand(&Command{
+		Name:   name,
+		Args:   strings.TrimSpace(args),
+		hub:    h,
+		client: client,
+	})
+	if err != nil {
+		h.sendError(client, ErrorCommand, err.Error())
+	}
+}
+
+// builtinCommands holds the state of the commands every hub has.
+type builtinCommands struct {
+	topic string
+	hands map[string]string // Names of the users who raised their hand, keyed by ID
+	poll  *poll
+}
+
+// poll is a question the users of a room vote on, one vote per user.
+type poll struct {
+	creatorID string
+	question  string
+	options   []string
+	votes     map[string]int // Option index, keyed by user ID
+}
+
+func newCommands() *commands {
+	c := &commands{handlers: make(map[string]registeredCommand)}
+	builtins := &builtinCommands{hands: make(map[string]string)}
+
+	c.handlers["help"] = registeredCommand{"/help", CommandHandlerFunc(func(command *Command) error {
+		command.hub.commands.mu.RLock()
+		usages := make([]string, 0, len(command.hub.commands.handlers))
+		for _, registered := range command.hub.commands.handlers {
+			usages = append(usages, registered.usage)
+		}
+		command.hub.commands.mu.RUnlock()
+
+		sort.Strings(usages)
+		command.Reply("commands: " + strings.Join(usages, ", "))
+		return nil
+	})}
+	c.handlers["topic"] = registeredCommand{"/topic [text]", CommandHandlerFunc(builtins.handleTopic)}
+	c.handlers["raise-hand"] = registeredCommand{"/raise-hand", CommandHandlerFunc(builtins.handleRaiseHand)}
+	c.handlers["lower-hand"] = registeredCommand{"/lower-hand [@user]", CommandHandlerFunc(builtins.handleLowerHand)}
+	c.handlers["hands"] = registeredCommand{"/hands", CommandHandlerFunc(builtins.handleHands)}
+	c.handlers["poll"] = registeredCommand{"/poll question | option | option...", CommandHandlerFunc(builtins.handlePoll)}
+	c.handlers["vote"] = registeredCommand{"/vote number", CommandHandlerFunc(builtins.handleVote)}
+	c.handlers["endpoll"] = registeredCommand{"/endpoll", CommandHandlerFunc(builtins.handleEndPoll)}
+
+	for _, action := range []ModerationAction{ActionMute, ActionUnmute, ActionKick, ActionBan, ActionUnban} {
+		usage := fmt.Sprintf("/%s @user", action)
+		if action == ActionMute {
+			usage += " [seconds]"
+		}
+		c.handlers[string(action)] = registeredCommand{usage, moderationCommand(action)}
+	}
+	return c
+}
+
+// moderationCommand applies a moderation action to the user named by the
+// arguments, as a moderate message would.
+func moderationCommand(action ModerationAction) CommandHandler {
+	return CommandHandlerFunc(func(command *Command) error {
+		fields := strings.Fields(command.Args)
+		if len(fields) == 0 {
+			return fmt.Errorf("/%s needs a user", action)
+		}
+		userID, err := command.hub.findUser(fields[0])
+		if err != nil {
+			return err
+		}
+
+		moderate := clientMessage{Type: MessageModerate, Action: action, UserID: userID}
+		if action == ActionMute && len(fields) > 1 {
+			if _, err := fmt.Sscan(fields[1], &moderate.Duration); err != nil || moderate.Duration < 0 {
+				return fmt.Errorf("invalid mute duration %q", fields[1])
+			}
+		}
+		command.hub.handleModeration(command.client, moderate)
+		return nil
+	})
+}
+
+// findUser returns the ID of a user named by "@display name" among the
+// connected users, or by its ID.
+func (h *CustomHub) findUser(name string) (string, error) {
+	displayName, ok := strings.CutPrefix(name, "@")
+	if !ok {
+		return name, nil
+	}
+
+	var found []string
+	for userID, user := range h.users {
+		for client := range user.clients {
+			if strings.EqualFold(client.DisplayName, displayName) {
+				found = append(found, userID)
+				break
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no user named %s is in the chat", displayName)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("several users are named %s, use their ID", displayName)
+	}
+}
+
+func (b *builtinCommands) handleTopic(command *Command) error {
+	if command.Args == "" {
+		if b.topic == "" {
+			command.Reply("no topic is set")
+		} else {
+			command.Reply("topic: " + b.topic)
+		}
+		return nil
+	}
+	if !command.Role().AtLeast(RoleModerator) {
+		return fmt.Errorf("only hosts and moderators can set the topic")
+	}
+
+	b.topic = command.Args
+	command.Broadcast(fmt.Sprintf("%s set the topic: %s", command.SenderName(), b.topic))
+	return nil
+}
+
+func (b *builtinCommands) handleRaiseHand(command *Command) error {
+	if _, ok := b.hands[command.SenderID()]; ok {
+		return fmt.Errorf("your hand is already raised")
+	}
+	b.hands[command.SenderID()] = command.SenderName()
+	command.Broadcast(fmt.Sprintf("%s raised their hand", command.SenderName()))
+	return nil
+}
+
+// handleLowerHand lowers the hand of the sender, or of another user for hosts
+// and moderators.
+func (b *builtinCommands) handleLowerHand(command *Command) error {
+	userID := command.SenderID()
+	if command.Args != "" {
+		if !command.Role().AtLeast(RoleModerator) {
+			return fmt.Errorf("only hosts and moderators can lower the hand of others")
+		}
+		var err error
+		if userID, err = command.hub.findUser(command.Args); err != nil {
+			return err
+		}
+	}
+
+	name, ok := b.hands[userID]
+	if !ok {
+		return fmt.Errorf("the hand is not raised")
+	}
+	delete(b.hands, userID)
+	command.Broadcast(fmt.Sprintf("%s lowered the hand of %s", command.SenderName(), name))
+	return nil
+}
+
+func (b *builtinCommands) handleHands(command *Command) error {
+	if len(b.hands) == 0 {
+		command.Reply("no hand is raised")
+		return nil
+	}
+
+	names := make([]string, 0, len(b.hands))
+	for _, name := range b.hands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	command.Reply("raised hands: " + strings.Join(names, ", "))
+	return nil
+}
+
+func (b *builtinCommands) handlePoll(command *Command) error {
+	if b.poll != nil {
+		return fmt.Errorf("a poll is already running, end it with /endpoll")
+	}
+
+	parts := strings.Split(command.Args, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 3 || parts[0] == "" {
+		return fmt.Errorf("usage: /poll question | option | option...")
+	}
+
+	b.poll = &poll{
+		creatorID: command.SenderID(),
+		question:  parts[0],
+		options:   parts[1:],
+		votes:     make(map[string]int),
+	}
+
+	lines := []string{fmt.Sprintf("%s started a poll: %s", command.SenderName(), b.poll.question)}
+	for i, option := range b.poll.options {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, option))
+	}
+	lines = append(lines, "vote with /vote <number>")
+	command.Broadcast(strings.Join(lines, "\n"))
+	return nil
+}
+
+func (b *builtinCommands) handleVote(command *Command) error {
+	if b.poll == nil {
+		return fmt.Errorf("no poll is running")
+	}
+
+	var option int
+	if _, err := fmt.Sscan(command.Args, &option); err != nil || option < 1 || option > len(b.poll.options) {
+		return fmt.Errorf("vote with a number from 1 to %d", len(b.poll.options))
+	}
+	b.poll.votes[command.SenderID()] = option - 1
+	command.Reply(fmt.Sprintf("you voted for %s", b.poll.options[option-1]))
+	return nil
+}
+
+// handleEndPoll ends the running poll and announces its results. Polls are
+// ended by their creator, a host or a moderator.
+func (b *builtinCommands) handleEndPoll(command *Command) error {
+	if b.poll == nil {
+		return fmt.Errorf("no poll is running")
+	}
+	if command.SenderID() != b.poll.creatorID && !command.Role().AtLeast(RoleModerator) {
+		return fmt.Errorf("only the creator of the poll, hosts and moderators can end it")
+	}
+
+	counts := make([]int, len(b.poll.options))
+	for _, option := range b.poll.votes {
+		counts[option]++
+	}
+
+	lines := []string{fmt.Sprintf("poll results: %s", b.poll.question)}
+	for i, option := range b.poll.options {
+		lines = append(lines, fmt.Sprintf("%d. %s: %d", i+1, option, counts[i]))
+	}
+	b.poll = nil
+	command.Broadcast(strings.Join(lines, "\n"))
+	return nil
+}
@@ -0,0 +1,27 @@
+package customchat
+
+// sendDirect delivers a private message to every connection of its recipient
+// and echoes it to the connections of the sender. Direct messages are not
+// stored, the chat history is visible to the whole room.
+func (h *CustomHub) sendDirect(sender *CustomClient, direct clientMessage) {
+	if direct.RecipientID == sender.ID {
+		h.sendError(sender, ErrorInvalid, "cannot send a direct message to yourself")
+		return
+	}
+
+	recipients := h.connections(direct.RecipientID)
+	if len(recipients) == 0 {
+		h.sendError(sender, ErrorNotFound, "the recipient is not in the chat")
+		return
+	}
+
+	message := h.newClientMessage(sender, MessageDirect, direct.Text)
+	message.RecipientID = direct.RecipientID
+
+	for client := range recipients {
+		h.sendTo(client, message)
+	}
+	for client := range h.connections(sender.ID) {
+		h.sendTo(client, message)
+	}
+}
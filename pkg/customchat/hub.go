@@ -1,49 +1,371 @@
 package customchat
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
 // CustomHub manages clients and message broadcasting.
 type CustomHub struct {
-	Clients    map[*CustomClient]bool
-	Broadcast  chan []byte
-	Register   chan *CustomClient
-	Unregister chan *CustomClient
+	RoomID       string
+	Store        ChatStore // Messages are kept here when set
+	HistorySize  int       // Number of stored messages replayed to a new client
+	QueueSize    int       // Messages buffered for a client besides the history
+	SlowConsumer SlowConsumerPolicy
+	Flood        FloodPolicy
+	OnMessage    func(message *Message) // Called on the event loop with every published message, must not block
+	Clients      map[*CustomClient]bool
+	Broadcast    chan *Message
+	Register     chan *CustomClient
+	Unregister   chan *CustomClient
+
+	incoming   chan incomingMessage
+	users      map[string]*chatUser // Connected users, keyed by ID
+	moderation *moderation
+	commands   *commands
+	roomBucket *tokenBucket // Rate limit of the room, created on the first message
+	typing     *tokenBucket // Limit of typing events forwarded in the room
+
+	ctx         context.Context // Canceled once the hub is stopped
+	cancel      context.CancelFunc
+	startOnce   sync.Once
+	stopOnce    sync.Once
+	closeReason string // Sent to the clients in the close frame once stopped
+}
+
+// SlowConsumerPolicy tells what happens to a message for a client whose
+// queue is full because it reads slower than the chat is written.
+type SlowConsumerPolicy int
+
+const (
+	SlowConsumerDropOldest SlowConsumerPolicy = iota // Drop the oldest queued message to make room
+	SlowConsumerDropNewest                           // Drop the new message
+	SlowConsumerDisconnect                           // Disconnect the client
+)
+
+// ParseSlowConsumerPolicy returns the policy named drop-oldest, drop-newest
+// or disconnect.
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for _, policy := range []SlowConsumerPolicy{SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerDisconnect} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy %q", name)
+}
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDropOldest:
+		return "drop-oldest"
+	case SlowConsumerDropNewest:
+		return "drop-newest"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
 }
 
-// NewCustomHub creates a new CustomHub instance.
-func NewCustomHub() *CustomHub {
+const (
+	// hubQueueSize is how many events are buffered for the event loop.
+	hubQueueSize = 64
+	// slowConsumerReason is sent to clients disconnected for not keeping up.
+	slowConsumerReason = "too slow"
+	// stoppedReason is sent to the clients when the context of the hub ends.
+	stoppedReason = "chat closed"
+)
+
+// NewCustomHub creates a new CustomHub instance for the chat of a room. The
+// store may be nil, the chat then has no history.
+func NewCustomHub(roomID string, store ChatStore) *CustomHub {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &CustomHub{
-		Clients:    make(map[*CustomClient]bool),
-		Broadcast:  make(chan []byte),
-		Register:   make(chan *CustomClient),
-		Unregister: make(chan *CustomClient),
+		RoomID:       roomID,
+		Store:        store,
+		HistorySize:  DefaultHistorySize,
+		QueueSize:    DefaultQueueSize,
+		SlowConsumer: SlowConsumerDropOldest,
+		Flood:        DefaultFloodPolicy,
+		Clients:      make(map[*CustomClient]bool),
+		Broadcast:    make(chan *Message, hubQueueSize),
+		Register:     make(chan *CustomClient),
+		Unregister:   make(chan *CustomClient),
+		incoming:     make(chan incomingMessage, hubQueueSize),
+		users:        make(map[string]*chatUser),
+		typing:       newTokenBucket(typingLimit),
+		moderation:   newModeration(),
+		ctx:          ctx,
+		cancel:       cancel,
+		commands:     newCommands(),
+	}
+}
+
+// Stop ends the event loop of the hub and disconnects every client with the
+// given reason. Stopping a stopped hub does nothing.
+func (h *CustomHub) Stop(reason string) {
+	h.stopOnce.Do(func() {
+		h.closeReason = reason
+		h.cancel()
+	})
+}
+
+// Done returns a channel that is closed when the hub is stopped.
+func (h *CustomHub) Done() <-chan struct{} {
+	return h.ctx.Done()
+}
+
+// register, unregister and receive hand an event to the event loop unless
+// the hub is stopped.
+func (h *CustomHub) register(client *CustomClient) bool {
+	select {
+	case h.Register <- client:
+		return true
+	case <-h.ctx.Done():
+		return false
+	}
+}
+
+func (h *CustomHub) unregister(client *CustomClient) {
+	select {
+	case h.Unregister <- client:
+	case <-h.ctx.Done():
+	}
+}
+
+// incomingMessage is a message read from a client. Invalid messages are
+// passed on too, they count against the rate limit of the client.
+type incomingMessage struct {
+	client  *CustomClient
+	message clientMessage
+	valid   bool
+}
+
+func (h *CustomHub) receive(client *CustomClient, message clientMessage, valid bool) {
+	select {
+	case h.incoming <- incomingMessage{client: client, message: message, valid: valid}:
+	case <-h.ctx.Done():
 	}
 }
 
 func (h *CustomHub) registerClient(client *CustomClient) {
-	h.Clients[client] = true
+	if h.Banned(client.ID) {
+		client.closeSend(bannedReason)
+		return
+	}
+
+	joined := h.addClient(client)
+	h.replayHistory(client)
+	h.sendPresenceList(client)
+	if joined {
+		h.broadcastMessage(h.newMessage(MessageSystem, fmt.Sprintf("%s joined", client.name())))
+		h.broadcastPresence(client, PresenceJoined)
+	}
 }
 
 func (h *CustomHub) unregisterClient(client *CustomClient) {
-	if _, ok := h.Clients[client]; ok {
-		delete(h.Clients, client)
-		close(client.Send)
+	if _, ok := h.Clients[client]; !ok {
+		return
+	}
+	left := h.deleteClient(client)
+	client.closeSend("")
+	if left {
+		h.broadcastMessage(h.newMessage(MessageSystem, fmt.Sprintf("%s left", client.name())))
+		h.broadcastPresence(client, PresenceLeft)
+	}
+}
+
+// handleIncoming stamps a message of a client with its identity and
+// publishes it, or applies it if it is a moderation command.
+func (h *CustomHub) handleIncoming(in incomingMessage) {
+	if _, ok := h.Clients[in.client]; !ok {
+		return
+	}
+
+	viewer := h.Role(in.client.ID) == RoleViewer
+	if in.valid && (in.message.Type == MessageTypingStart || in.message.Type == MessageTypingStop) {
+		if !viewer {
+			h.handleTyping(in.client, in.message.Type)
+		}
+		return
+	}
+	h.touch(in.client)
+	// Muted clients are turned away before their messages count against the
+	// rate limit, which would otherwise turn the mute into a disconnection
+	if in.valid && in.message.Type != MessageModerate && !viewer && h.Muted(in.client.ID) {
+		h.sendError(in.client, ErrorMuted, "you are muted")
+		return
+	}
+	if !h.allowMessage(in.client) {
+		return
+	}
+	if !in.valid {
+		h.sendError(in.client, ErrorInvalid, "the message is empty or of an unknown type")
+		return
+	}
+
+	switch in.message.Type {
+	case MessageModerate:
+		h.handleModeration(in.client, in.message)
+		return
+	}
+
+	if viewer {
+		h.sendError(in.client, ErrorForbidden, "you may only read this chat")
+		return
+	}
+	switch in.message.Type {
+	case MessageDirect:
+		h.sendDirect(in.client, in.message)
+	case MessageReaction, MessageUnreaction:
+		h.react(in.client, in.message)
+	case MessageEdit:
+		h.editMessage(in.client, in.message)
+	default:
+		if isCommand(in.message.Text) {
+			h.runCommand(in.client, in.message.Text)
+			return
+		}
+		h.publishReply(in.client, in.message)
+	}
+}
+
+// replayHistory queues the latest stored messages for a new client. Its send
+// queue has room for them.
+func (h *CustomHub) replayHistory(client *CustomClient) {
+	if h.Store == nil || h.HistorySize <= 0 {
+		return
+	}
+
+	messages, err := h.Store.History(h.RoomID, "", h.HistorySize)
+	if err != nil {
+		log.Printf("error loading chat history: %v", err)
+		return
+	}
+
+	for _, message := range messages {
+		raw, err := json.Marshal(message)
+		if err != nil {
+			log.Printf("error encoding message: %v", err)
+			continue
+		}
+
+		select {
+		case client.Send <- raw:
+		default:
+			return
+		}
+	}
+}
+
+// publishMessage stores a message and sends it to every client.
+func (h *CustomHub) publishMessage(message *Message) {
+	if h.Store != nil {
+		if err := h.Store.Append(message); err != nil {
+			log.Printf("error storing message: %v", err)
+		}
+	}
+	h.broadcastMessage(message)
+	if h.OnMessage != nil {
+		h.OnMessage(message)
+	}
+}
+
+// removeClient disconnects a client, closing its websocket with the given
+// reason.
+func (h *CustomHub) removeClient(client *CustomClient, reason string) {
+	if _, ok := h.Clients[client]; !ok {
+		return
+	}
+	left := h.deleteClient(client)
+	client.closeSend(reason)
+	if left {
+		h.broadcastPresence(client, PresenceLeft)
 	}
 }
 
-func (h *CustomHub) broadcastMessage(message []byte) {
+// sendTo sends a message to a single client.
+func (h *CustomHub) sendTo(client *CustomClient, message *Message) {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("error encoding message: %v", err)
+		return
+	}
+	h.enqueue(client, raw)
+}
+
+func (h *CustomHub) broadcastMessage(message *Message) {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("error encoding message: %v", err)
+		return
+	}
+
 	for client := range h.Clients {
+		h.enqueue(client, raw)
+	}
+}
+
+// enqueue queues an encoded message for a client, applying the slow consumer
+// policy if its queue is full. The write loop of the client is the only other
+// party using the queue, so it cannot fill up again while a message is
+// dropped.
+func (h *CustomHub) enqueue(client *CustomClient, raw []byte) {
+	select {
+	case client.Send <- raw:
+		return
+	default:
+	}
+
+	switch h.SlowConsumer {
+	case SlowConsumerDropNewest:
+	case SlowConsumerDropOldest:
+		select {
+		case <-client.Send:
+		default:
+		}
 		select {
-		case client.Send <- message:
+		case client.Send <- raw:
 		default:
-			close(client.Send)
-			delete(h.Clients, client)
 		}
+	default:
+		h.removeClient(client, slowConsumerReason)
 	}
 }
 
-// Start starts the CustomHub's event loop for managing clients and broadcasting messages.
-func (h *CustomHub) Start() {
+// Start runs the event loop of the hub, managing clients and broadcasting
+// messages, until the hub is stopped or ctx ends. The clients still connected
+// are then disconnected. Starting a started hub returns at once.
+func (h *CustomHub) Start(ctx context.Context) {
+	started := false
+	h.startOnce.Do(func() { started = true })
+	if !started {
+		return
+	}
+
+	defer func() {
+		for client := range h.Clients {
+			h.deleteClient(client)
+			client.closeSend("")
+		}
+	}()
+
+	presenceTicker := time.NewTicker(presenceInterval)
+	defer presenceTicker.Stop()
+
 	for {
 		select {
+		case <-ctx.Done():
+			h.Stop(stoppedReason)
+			return
+
+		case <-h.ctx.Done():
+			return
+
 		case client := <-h.Register:
 			h.registerClient(client)
 
@@ -51,7 +373,13 @@ func (h *CustomHub) Start() {
 			h.unregisterClient(client)
 
 		case message := <-h.Broadcast:
-			h.broadcastMessage(message)
+			h.publishMessage(message)
+
+		case in := <-h.incoming:
+			h.handleIncoming(in)
+
+		case now := <-presenceTicker.C:
+			h.markIdle(now)
 		}
 	}
 }
@@ -0,0 +1,141 @@
+package customchat
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	gguid "github.com/google/uuid"
+)
+
+// MessageType identifies the kind of a chat message.
+type MessageType string
+
+const (
+	MessageText        MessageType = "text"
+	MessageSystem      MessageType = "system"       // Sent by the server, never accepted from clients
+	MessageReaction    MessageType = "reaction"     // Adds the reaction in Text, such as an emoji, to the message named by MessageID
+	MessageUnreaction  MessageType = "unreaction"   // Takes a reaction back
+	MessageEdit        MessageType = "edit"         // Replaces the text of a message of the sender
+	MessageEdited      MessageType = "edited"       // Tells the clients about an edit
+	MessageModerate    MessageType = "moderate"     // Moderation command sent by a host or moderator
+	MessageDeleted     MessageType = "deleted"      // Tombstone of the message named by MessageID
+	MessageError       MessageType = "error"        // Sent to a client whose message was rejected, Code tells why
+	MessageDirect      MessageType = "direct"       // Private message to the user named by RecipientID
+	MessagePresence    MessageType = "presence"     // A user joined, left, went idle or came back, Status tells which
+	MessagePresent     MessageType = "present"      // Users in the chat, sent to a client when it connects
+	MessageTypingStart MessageType = "typing-start" // The sender started typing, valid for a few seconds unless repeated
+	MessageTypingStop  MessageType = "typing-stop"  // The sender stopped typing
+)
+
+// Error codes of error messages.
+const (
+	ErrorInvalid         = "invalid"           // The message could not be understood
+	ErrorRateLimited     = "rate-limited"      // The client sends too many messages
+	ErrorRoomRateLimited = "room-rate-limited" // The room receives too many messages
+	ErrorMuted           = "muted"             // The client may not send messages
+	ErrorForbidden       = "forbidden"         // The client is not allowed to do this
+	ErrorNotFound        = "not-found"         // The recipient or the message referred to does not exist
+	ErrorCommand         = "command"           // The slash command failed, Text tells why
+	ErrorFailed          = "failed"            // The server could not apply the message
+)
+
+// Message is the envelope of every chat message sent to the clients. The
+// identity of the sender and the timestamp are set by the hub, clients only
+// choose the type and the text.
+type Message struct {
+	ID          string      `json:"id"`
+	RoomID      string      `json:"roomId"`
+	Type        MessageType `json:"type"`
+	SenderID    string      `json:"senderId,omitempty"`
+	RecipientID string      `json:"recipientId,omitempty"` // Recipient of direct messages
+	DisplayName string      `json:"displayName,omitempty"`
+	Text        string      `json:"text"`
+	MessageID   string      `json:"messageId,omitempty"` // Message an event refers to
+	ReplyTo     string      `json:"replyTo,omitempty"`   // Message this one answers
+	Deleted     bool        `json:"deleted,omitempty"`   // Set on stored messages that were deleted
+	Code        string      `json:"code,omitempty"`      // Error code of error messages
+	Timestamp   time.Time   `json:"timestamp"`
+
+	Reactions map[string][]string `json:"reactions,omitempty"` // IDs of the users who reacted, by reaction
+	Edits     []MessageRevision   `json:"edits,omitempty"`     // Last previous texts, oldest first
+	Status    PresenceStatus      `json:"status,omitempty"`    // Presence change of the sender
+	Users     []PresenceUser      `json:"users,omitempty"`     // Users in the chat
+}
+
+// MessageRevision is a previous text of an edited message.
+type MessageRevision struct {
+	Text     string    `json:"text"`
+	EditedAt time.Time `json:"editedAt"` // When the text was replaced
+}
+
+// clientMessage is what clients send. Plain text that is not JSON is accepted
+// as a text message. Direct messages name their recipient, moderation
+// commands the action and its target.
+type clientMessage struct {
+	Type        MessageType      `json:"type"`
+	Text        string           `json:"text"`
+	RecipientID string           `json:"recipientId,omitempty"`
+	Action      ModerationAction `json:"action,omitempty"`
+	UserID      string           `json:"userId,omitempty"`
+	MessageID   string           `json:"messageId,omitempty"`
+	ReplyTo     string           `json:"replyTo,omitempty"`
+	Duration    int              `json:"duration,omitempty"` // Mute duration in seconds, 0 until unmuted
+}
+
+// parseClientMessage decodes a message read from a client. It reports false
+// for messages that must not be broadcast.
+func parseClientMessage(raw []byte) (clientMessage, bool) {
+	message := clientMessage{}
+	if err := json.Unmarshal(raw, &message); err != nil {
+		message = clientMessage{Type: MessageText, Text: string(raw)}
+	}
+	if message.Type == "" {
+		message.Type = MessageText
+	}
+
+	message.Text = strings.TrimSpace(message.Text)
+
+	switch message.Type {
+	case MessageText:
+		return message, message.Text != ""
+	case MessageReaction, MessageUnreaction:
+		return message, message.MessageID != "" && message.Text != "" && len(message.Text) <= maxReactionSize
+	case MessageEdit:
+		return message, message.MessageID != "" && message.Text != ""
+	case MessageTypingStart, MessageTypingStop:
+		return message, true
+	case MessageDirect:
+		return message, message.Text != "" && message.RecipientID != ""
+	case MessageModerate:
+		return message, message.Action != ""
+	default:
+		return message, false
+	}
+}
+
+// newMessage stamps a message with a new ID, the room and the current time.
+func (h *CustomHub) newMessage(typ MessageType, text string) *Message {
+	return &Message{
+		ID:        gguid.New().String(),
+		RoomID:    h.RoomID,
+		Type:      typ,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// newClientMessage stamps a message sent by a client with its identity.
+func (h *CustomHub) newClientMessage(client *CustomClient, typ MessageType, text string) *Message {
+	message := h.newMessage(typ, text)
+	message.SenderID = client.ID
+	message.DisplayName = client.DisplayName
+	return message
+}
+
+// sendError tells a client why its message was rejected.
+func (h *CustomHub) sendError(client *CustomClient, code, text string) {
+	message := h.newMessage(MessageError, text)
+	message.Code = code
+	h.sendTo(client, message)
+}
@@ -0,0 +1,281 @@
+package customchat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Role is the standing of a chat user in a room.
+type Role int
+
+const (
+	RoleMember    Role = iota // Sends messages
+	RoleModerator             // Can mute, kick, ban and delete messages of members
+	RoleHost                  // Owns the room, can also appoint moderators
+	RoleViewer                // Reads the chat but cannot send to it
+)
+
+// AtLeast reports whether r may do everything other may do. Viewers rank
+// below members.
+func (r Role) AtLeast(other Role) bool {
+	return r.rank() >= other.rank()
+}
+
+func (r Role) rank() int {
+	if r == RoleViewer {
+		return -1
+	}
+	return int(r)
+}
+
+// ModerationAction is a command of a moderation message.
+type ModerationAction string
+
+const (
+	ActionMute    ModerationAction = "mute"    // Stop a user from sending messages
+	ActionUnmute  ModerationAction = "unmute"  // Lift a mute
+	ActionKick    ModerationAction = "kick"    // Disconnect a user, who may join again
+	ActionBan     ModerationAction = "ban"     // Disconnect a user and reject it until unbanned
+	ActionUnban   ModerationAction = "unban"   // Lift a ban
+	ActionDelete  ModerationAction = "delete"  // Replace a message with a tombstone
+	ActionPromote ModerationAction = "promote" // Make a user moderator, hosts only
+	ActionDemote  ModerationAction = "demote"  // Take the moderator role back, hosts only
+)
+
+// Close reasons sent to removed clients.
+const (
+	kickedReason = "kicked"
+	bannedReason = "banned"
+)
+
+// moderation holds the roles and sanctions of the users of a room, keyed by
+// their identity.
+type moderation struct {
+	mu         sync.RWMutex
+	owner      string
+	moderators map[string]bool
+	grants     map[string]grant
+	muted      map[string]time.Time // Mute expiry, zero while muted until unmuted
+	banned     map[string]bool
+}
+
+func newModeration() *moderation {
+	return &moderation{
+		moderators: make(map[string]bool),
+		grants:     make(map[string]grant),
+		muted:      make(map[string]time.Time),
+		banned:     make(map[string]bool),
+	}
+}
+
+// SetOwner makes a user the host of the room.
+func (h *CustomHub) SetOwner(userID string) {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+
+	h.moderation.owner = userID
+}
+
+// Owner returns the owner of the room, empty if it has none.
+func (h *CustomHub) Owner() string {
+	h.moderation.mu.RLock()
+	defer h.moderation.mu.RUnlock()
+
+	return h.moderation.owner
+}
+
+// ClaimOwner makes a user the host of a room that has none and reports
+// whether it did.
+func (h *CustomHub) ClaimOwner(userID string) bool {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+
+	if userID == "" || h.moderation.owner != "" {
+		return false
+	}
+	h.moderation.owner = userID
+	return true
+}
+
+// grant is a role given to a user by its access token, which lapses with the
+// token.
+type grant struct {
+	role    Role
+	expires time.Time
+}
+
+// Grant gives a user the role its access token carries until the token
+// expires, replacing the role of its previous token. Once the grant lapses
+// the user may only read the chat, until it connects with a new token.
+func (h *CustomHub) Grant(userID string, role Role, expires time.Time) {
+	h.setSanction(func(m *moderation) { m.grants[userID] = grant{role: role, expires: expires} })
+}
+
+// Role returns the role of a user in the room. The owner is the host, then
+// the grant of its token counts, except that members may be promoted.
+func (h *CustomHub) Role(userID string) Role {
+	h.moderation.mu.RLock()
+	defer h.moderation.mu.RUnlock()
+
+	if userID != "" && userID == h.moderation.owner {
+		return RoleHost
+	}
+	if grant, ok := h.moderation.grants[userID]; ok {
+		if !time.Now().Before(grant.expires) {
+			return RoleViewer
+		}
+		if grant.role != RoleMember {
+			return grant.role
+		}
+	}
+	if h.moderation.moderators[userID] {
+		return RoleModerator
+	}
+	return RoleMember
+}
+
+// Banned reports whether a user is banned from the room.
+func (h *CustomHub) Banned(userID string) bool {
+	h.moderation.mu.RLock()
+	defer h.moderation.mu.RUnlock()
+
+	return h.moderation.banned[userID]
+}
+
+// Muted reports whether a user may currently not send messages.
+func (h *CustomHub) Muted(userID string) bool {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+
+	expiry, ok := h.moderation.muted[userID]
+	if !ok {
+		return false
+	}
+	if !expiry.IsZero() && time.Now().After(expiry) {
+		delete(h.moderation.muted, userID)
+		return false
+	}
+	return true
+}
+
+// handleModeration applies a moderation command of a client. It runs on the
+// event loop of the hub.
+func (h *CustomHub) handleModeration(client *CustomClient, command clientMessage) {
+	if err := h.authorize(client, command); err != nil {
+		h.sendError(client, ErrorForbidden, err.Error())
+		return
+	}
+
+	switch command.Action {
+	case ActionMute:
+		var expiry time.Time
+		if command.Duration > 0 {
+			expiry = time.Now().Add(time.Duration(command.Duration) * time.Second)
+		}
+		h.setSanction(func(m *moderation) { m.muted[command.UserID] = expiry })
+		h.announce(client, "muted", command.UserID)
+	case ActionUnmute:
+		h.setSanction(func(m *moderation) { delete(m.muted, command.UserID) })
+		h.announce(client, "unmuted", command.UserID)
+	case ActionKick:
+		h.announce(client, "kicked", command.UserID)
+		h.disconnect(command.UserID, kickedReason)
+	case ActionBan:
+		h.setSanction(func(m *moderation) { m.banned[command.UserID] = true })
+		h.announce(client, "banned", command.UserID)
+		h.disconnect(command.UserID, bannedReason)
+	case ActionUnban:
+		h.setSanction(func(m *moderation) { delete(m.banned, command.UserID) })
+		h.announce(client, "unbanned", command.UserID)
+	case ActionPromote:
+		h.setSanction(func(m *moderation) { m.moderators[command.UserID] = true })
+		h.announce(client, "made a moderator", command.UserID)
+	case ActionDemote:
+		h.setSanction(func(m *moderation) { delete(m.moderators, command.UserID) })
+		h.announce(client, "removed as moderator", command.UserID)
+	case ActionDelete:
+		h.deleteMessage(client, command.MessageID)
+	}
+}
+
+// authorize checks that a client may apply a command. Moderators can only act
+// on members, and only the host appoints moderators.
+func (h *CustomHub) authorize(client *CustomClient, command clientMessage) error {
+	role := h.Role(client.ID)
+	if !role.AtLeast(RoleModerator) {
+		return fmt.Errorf("only hosts and moderators can %s", command.Action)
+	}
+
+	switch command.Action {
+	case ActionDelete:
+		if command.MessageID == "" {
+			return fmt.Errorf("%s needs a messageId", command.Action)
+		}
+		return nil
+	case ActionPromote, ActionDemote:
+		if !role.AtLeast(RoleHost) {
+			return fmt.Errorf("only hosts can %s", command.Action)
+		}
+	case ActionMute, ActionUnmute, ActionKick, ActionBan, ActionUnban:
+	default:
+		return fmt.Errorf("unknown action %q", command.Action)
+	}
+
+	if command.UserID == "" {
+		return fmt.Errorf("%s needs a userId", command.Action)
+	}
+	if command.UserID == client.ID {
+		return fmt.Errorf("cannot %s yourself", command.Action)
+	}
+	if h.Role(command.UserID).AtLeast(role) {
+		return fmt.Errorf("cannot %s a user with the same or a higher role", command.Action)
+	}
+	return nil
+}
+
+func (h *CustomHub) setSanction(update func(*moderation)) {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+
+	update(h.moderation)
+}
+
+// announce tells the room about a moderation command.
+func (h *CustomHub) announce(moderator *CustomClient, action, userID string) {
+	h.publishMessage(h.newMessage(MessageSystem, fmt.Sprintf("%s was %s by %s", h.userName(userID), action, moderator.name())))
+}
+
+// userName returns the name of a connected user, or its ID if it is not
+// connected.
+func (h *CustomHub) userName(userID string) string {
+	for client := range h.connections(userID) {
+		return client.name()
+	}
+	return userID
+}
+
+// disconnect removes every client of a user from the hub, closing their
+// websockets with the given reason.
+func (h *CustomHub) disconnect(userID, reason string) {
+	for client := range h.connections(userID) {
+		h.removeClient(client, reason)
+	}
+}
+
+// deleteMessage replaces a stored message with a tombstone and tells the
+// clients to remove it.
+func (h *CustomHub) deleteMessage(moderator *CustomClient, messageID string) {
+	if h.Store != nil {
+		if err := h.Store.Delete(h.RoomID, messageID); err != nil {
+			log.Printf("error deleting message: %v", err)
+			h.sendError(moderator, ErrorFailed, "the message could not be deleted")
+			return
+		}
+	}
+
+	event := h.newClientMessage(moderator, MessageDeleted, "")
+	event.MessageID = messageID
+	h.broadcastMessage(event)
+}
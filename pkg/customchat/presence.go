@@ -0,0 +1,193 @@
+package customchat
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+// PresenceStatus is the presence of a user in a chat.
+type PresenceStatus string
+
+const (
+	PresenceJoined PresenceStatus = "joined" // The first connection of the user joined
+	PresenceLeft   PresenceStatus = "left"   // The last connection of the user left
+	PresenceIdle   PresenceStatus = "idle"   // The user sent nothing for a while
+	PresenceActive PresenceStatus = "active" // The user is in the chat and not idle
+)
+
+const (
+	presenceInterval = 15 * time.Second // How often users are checked for idleness
+	idleAfter        = 2 * time.Minute  // Inactivity after which a user is idle
+
+	// typingInterval is how often the typing-start event of a user is
+	// forwarded at most, whether the user keeps typing or stopped in between.
+	typingInterval = 3 * time.Second
+)
+
+// typingLimit bounds the typing events forwarded in a room, so that large
+// rooms are not flooded with them. Events over the limit are dropped.
+var typingLimit = RateLimit{Rate: 10, Burst: 10}
+
+// PresenceUser is a user in a chat.
+type PresenceUser struct {
+	UserID      string         `json:"userId"`
+	DisplayName string         `json:"displayName,omitempty"`
+	Status      PresenceStatus `json:"status"`
+}
+
+// chatUser is a user connected to the hub with one or more clients. It is
+// only used by the event loop of the hub.
+type chatUser struct {
+	clients    map[*CustomClient]bool
+	lastActive time.Time
+	idle       bool
+	typing     bool
+	lastTyping time.Time // When a typing-start event was last forwarded
+}
+
+// connections returns the clients of a user, nil if the user is not
+// connected.
+func (h *CustomHub) connections(userID string) map[*CustomClient]bool {
+	if user, ok := h.users[userID]; ok {
+		return user.clients
+	}
+	return nil
+}
+
+// addClient adds a client to the hub and reports whether it is the first
+// connection of its user.
+func (h *CustomHub) addClient(client *CustomClient) bool {
+	h.Clients[client] = true
+
+	user, ok := h.users[client.ID]
+	if !ok {
+		user = &chatUser{clients: make(map[*CustomClient]bool)}
+		h.users[client.ID] = user
+	}
+	user.clients[client] = true
+	user.lastActive = time.Now()
+	return !ok
+}
+
+// deleteClient removes a client from the hub and reports whether it was the
+// last connection of its user.
+func (h *CustomHub) deleteClient(client *CustomClient) bool {
+	delete(h.Clients, client)
+
+	user, ok := h.users[client.ID]
+	if !ok {
+		return false
+	}
+	delete(user.clients, client)
+	if len(user.clients) > 0 {
+		return false
+	}
+	delete(h.users, client.ID)
+	return true
+}
+
+// touch records activity of a client, bringing its user back from idle.
+func (h *CustomHub) touch(client *CustomClient) {
+	user, ok := h.users[client.ID]
+	if !ok {
+		return
+	}
+	user.lastActive = time.Now()
+	if user.idle {
+		user.idle = false
+		h.broadcastPresence(client, PresenceActive)
+	}
+}
+
+// markIdle tells the room about the users that have been inactive for a
+// while.
+func (h *CustomHub) markIdle(now time.Time) {
+	for _, user := range h.users {
+		if user.idle || now.Sub(user.lastActive) < idleAfter {
+			continue
+		}
+		user.idle = true
+		for client := range user.clients {
+			h.broadcastPresence(client, PresenceIdle)
+			break
+		}
+	}
+}
+
+// sendPresenceList tells a new client who is in the chat.
+func (h *CustomHub) sendPresenceList(client *CustomClient) {
+	message := h.newMessage(MessagePresent, "")
+	message.Users = make([]PresenceUser, 0, len(h.users))
+	for userID, user := range h.users {
+		present := PresenceUser{UserID: userID, Status: PresenceActive}
+		if user.idle {
+			present.Status = PresenceIdle
+		}
+		for connection := range user.clients {
+			present.DisplayName = connection.DisplayName
+			break
+		}
+		message.Users = append(message.Users, present)
+	}
+	sort.Slice(message.Users, func(i, j int) bool { return message.Users[i].UserID < message.Users[j].UserID })
+	h.sendTo(client, message)
+}
+
+func (h *CustomHub) broadcastPresence(client *CustomClient, status PresenceStatus) {
+	message := h.newClientMessage(client, MessagePresence, "")
+	message.Status = status
+	h.broadcastMessage(message)
+}
+
+// handleTyping forwards typing events of a client to the other clients. The
+// typing-start event of a user is forwarded once per interval at most, so that
+// one user cannot use up the limit of the room, and typing-stop only follows
+// a forwarded typing-start. The events are ephemeral: they are not stored,
+// do not count as activity and are dropped when the room sends too many.
+func (h *CustomHub) handleTyping(client *CustomClient, typ MessageType) {
+	user, ok := h.users[client.ID]
+	if !ok || h.Muted(client.ID) {
+		return
+	}
+
+	now := time.Now()
+	switch typ {
+	case MessageTypingStart:
+		if now.Sub(user.lastTyping) < typingInterval {
+			return
+		}
+	case MessageTypingStop:
+		if !user.typing {
+			return
+		}
+	}
+	if !h.typing.allow(now) {
+		return
+	}
+
+	user.typing = typ == MessageTypingStart
+	if user.typing {
+		user.lastTyping = now
+	}
+
+	raw, err := json.Marshal(h.newClientMessage(client, typ, ""))
+	if err != nil {
+		log.Printf("error encoding message: %v", err)
+		return
+	}
+	for other := range h.Clients {
+		if other.ID != client.ID {
+			h.enqueue(other, raw)
+		}
+	}
+}
+
+// stopTyping forgets that a user is typing once it sent its message, the
+// clients stop showing the indicator when they receive it.
+func (h *CustomHub) stopTyping(client *CustomClient) {
+	if user, ok := h.users[client.ID]; ok {
+		user.typing = false
+	}
+}
@@ -0,0 +1,141 @@
+package customchat
+
+import (
+	"fmt"
+	"time"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second that holds
+// up to Burst tokens. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// FloodPolicy limits how fast messages are sent in a chat and how clients that
+// keep exceeding their limit are penalized: the first violations are answered
+// with a warning, then the client is muted for a while and finally
+// disconnected. Violations are forgotten after a quiet period.
+type FloodPolicy struct {
+	Client          RateLimit     // Limit of each client
+	Room            RateLimit     // Limit of all the clients of a room together
+	Warnings        int           // Violations answered with a warning only
+	MuteDuration    time.Duration // Mute after the warnings
+	DisconnectAfter int           // Violations after which the client is disconnected
+	ForgetAfter     time.Duration // Quiet period after which violations are forgotten
+}
+
+// DefaultFloodPolicy is the flood policy of a hub unless configured otherwise.
+var DefaultFloodPolicy = FloodPolicy{
+	Client:          RateLimit{Rate: 1, Burst: 5},
+	Room:            RateLimit{Rate: 20, Burst: 40},
+	Warnings:        2,
+	MuteDuration:    30 * time.Second,
+	DisconnectAfter: 5,
+	ForgetAfter:     time.Minute,
+}
+
+// floodReason is sent to clients disconnected for flooding.
+const floodReason = "flooding"
+
+// tokenBucket implements a RateLimit. It is only used on the event loop of
+// the hub.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.limit.Rate <= 0 {
+		return true
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodState tracks the rate limit and the violations of a client.
+type floodState struct {
+	bucket        *tokenBucket
+	violations    int
+	lastViolation time.Time
+}
+
+// allowMessage applies the flood policy to a message of a client and reports
+// whether it may be processed. Rejected messages are answered with an error
+// and the client is penalized. The room limit rejects messages without
+// penalty, the client is not to blame for the others.
+func (h *CustomHub) allowMessage(client *CustomClient) bool {
+	now := time.Now()
+	if client.flood == nil {
+		client.flood = &floodState{bucket: newTokenBucket(h.Flood.Client)}
+	}
+
+	if !client.flood.bucket.allow(now) {
+		h.penalize(client, now)
+		return false
+	}
+
+	if h.roomBucket == nil {
+		h.roomBucket = newTokenBucket(h.Flood.Room)
+	}
+	if !h.roomBucket.allow(now) {
+		h.sendError(client, ErrorRoomRateLimited, "the room is too busy, try again shortly")
+		return false
+	}
+	return true
+}
+
+func (h *CustomHub) penalize(client *CustomClient, now time.Time) {
+	state := client.flood
+	if h.Flood.ForgetAfter > 0 && now.Sub(state.lastViolation) > h.Flood.ForgetAfter {
+		state.violations = 0
+	}
+	state.violations++
+	state.lastViolation = now
+
+	switch {
+	case h.Flood.DisconnectAfter > 0 && state.violations >= h.Flood.DisconnectAfter:
+		h.sendError(client, ErrorRateLimited, "disconnected for sending too many messages")
+		h.removeClient(client, floodReason)
+	case state.violations > h.Flood.Warnings && h.Flood.MuteDuration > 0:
+		var extended bool
+		h.setSanction(func(m *moderation) { extended = m.muteUntil(client.ID, now.Add(h.Flood.MuteDuration)) })
+		if !extended {
+			h.sendError(client, ErrorRateLimited, "slow down, you are sending too many messages")
+			return
+		}
+		h.sendError(client, ErrorRateLimited, fmt.Sprintf("muted for %s for sending too many messages", h.Flood.MuteDuration))
+	default:
+		h.sendError(client, ErrorRateLimited, "slow down, you are sending too many messages")
+	}
+}
+
+// muteUntil mutes a user until the given time and reports whether it did. A
+// mute that lasts longer, such as one of a moderator without expiry, is kept.
+func (m *moderation) muteUntil(userID string, until time.Time) bool {
+	if expiry, ok := m.muted[userID]; ok && (expiry.IsZero() || !expiry.Before(until)) {
+		return false
+	}
+	m.muted[userID] = until
+	return true
+}
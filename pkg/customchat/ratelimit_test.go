@@ -0,0 +1,154 @@
+package customchat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name  string
+		limit RateLimit
+		at    []time.Duration // Times of the attempts after the bucket was created
+		want  []bool
+	}{
+		{
+			name:  "burst",
+			limit: RateLimit{Rate: 1, Burst: 2},
+			at:    []time.Duration{0, 0, 0},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "refill",
+			limit: RateLimit{Rate: 2, Burst: 1},
+			at:    []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond},
+			want:  []bool{true, false, false, true},
+		},
+		{
+			name:  "refill up to the burst",
+			limit: RateLimit{Rate: 10, Burst: 2},
+			at:    []time.Duration{time.Minute, time.Minute, time.Minute},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "disabled",
+			limit: RateLimit{Burst: 1},
+			at:    []time.Duration{0, 0, 0},
+			want:  []bool{true, true, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := newTokenBucket(test.limit)
+			bucket.last = start
+
+			for i, at := range test.at {
+				if got := bucket.allow(start.Add(at)); got != test.want[i] {
+					t.Errorf("allow() #%d at %s = %v, want %v", i+1, at, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPenalize(t *testing.T) {
+	policy := FloodPolicy{
+		Warnings:        1,
+		MuteDuration:    time.Minute,
+		DisconnectAfter: 4,
+		ForgetAfter:     time.Hour,
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name           string
+		violations     []time.Duration // Times of the violations after now
+		muted          *time.Time      // Mute before the violations
+		wantMute       time.Time       // Zero if the client must not be muted
+		wantRemoved    bool
+		wantIndefinite bool
+	}{
+		{
+			name:       "warning",
+			violations: []time.Duration{0},
+		},
+		{
+			name:       "muted after the warnings",
+			violations: []time.Duration{0, time.Second},
+			wantMute:   now.Add(time.Second + time.Minute),
+		},
+		{
+			name:        "disconnected",
+			violations:  []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second},
+			wantMute:    now.Add(2*time.Second + time.Minute),
+			wantRemoved: true,
+		},
+		{
+			name:       "violations forgotten",
+			violations: []time.Duration{0, 2 * time.Hour},
+		},
+		{
+			name:           "indefinite mute kept",
+			violations:     []time.Duration{0, 0},
+			muted:          &time.Time{},
+			wantIndefinite: true,
+		},
+		{
+			name:       "longer mute kept",
+			violations: []time.Duration{0, 0},
+			muted:      timePointer(now.Add(time.Hour)),
+			wantMute:   now.Add(time.Hour),
+		},
+		{
+			name:       "shorter mute extended",
+			violations: []time.Duration{0, 0},
+			muted:      timePointer(now.Add(time.Second)),
+			wantMute:   now.Add(time.Minute),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hub := NewCustomHub("room", nil)
+			hub.Flood = policy
+			client := &CustomClient{
+				ID:    "alice",
+				Hub:   hub,
+				Send:  make(chan []byte, DefaultQueueSize),
+				flood: &floodState{bucket: newTokenBucket(policy.Client)},
+			}
+			hub.Clients[client] = true
+			if test.muted != nil {
+				hub.moderation.muted[client.ID] = *test.muted
+			}
+
+			for _, at := range test.violations {
+				hub.penalize(client, now.Add(at))
+			}
+
+			expiry, muted := hub.moderation.muted[client.ID]
+			switch {
+			case test.wantIndefinite:
+				if !muted || !expiry.IsZero() {
+					t.Errorf("mute = %v, %v, want indefinite", expiry, muted)
+				}
+			case test.wantMute.IsZero():
+				if muted {
+					t.Errorf("mute = %v, want none", expiry)
+				}
+			case !muted || !expiry.Equal(test.wantMute):
+				t.Errorf("mute = %v, %v, want until %v", expiry, muted, test.wantMute)
+			}
+			if removed := !hub.Clients[client]; removed != test.wantRemoved {
+				t.Errorf("removed = %v, want %v", removed, test.wantRemoved)
+			}
+		})
+	}
+}
+
+func timePointer(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,221 @@
+package customchat
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// DefaultHistorySize is how many recent messages a client receives when
+	// it joins the chat.
+	DefaultHistorySize = 50
+	// defaultMemoryStoreSize is how many messages the in-memory store keeps
+	// per room.
+	defaultMemoryStoreSize = 500
+)
+
+// ErrMessageNotFound is returned for messages the store does not have.
+var ErrMessageNotFound = errors.New("message not found")
+
+// ChatStore persists the messages of the chats of every room.
+type ChatStore interface {
+	// Append stores a message of the room named by its RoomID.
+	Append(message *Message) error
+	// History returns up to limit messages of a room sent before the message
+	// with the given ID, or the most recent ones if beforeID is empty. The
+	// messages are in the order they were sent.
+	History(roomID, beforeID string, limit int) ([]*Message, error)
+	// Get returns a stored message, or ErrMessageNotFound.
+	Get(roomID, messageID string) (*Message, error)
+	// Delete replaces a stored message with a tombstone, dropping its text.
+	// Deleting an unknown message does nothing.
+	Delete(roomID, messageID string) error
+	// Update applies a change to a copy of a stored message and stores the
+	// copy unless the change fails. It returns the updated message, or
+	// ErrMessageNotFound.
+	Update(roomID, messageID string, update func(*Message) error) (*Message, error)
+	// CloseRoom is called when a room closes and deletes its history.
+	CloseRoom(roomID string) error
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// MemoryChatStore is a ChatStore keeping the latest messages of each room in
+// a ring buffer. The history is lost when the room closes or the process
+// exits.
+type MemoryChatStore struct {
+	size int
+
+	mu    sync.RWMutex
+	rooms map[string]*messageRing
+}
+
+// messageRing holds the latest messages of a room, overwriting the oldest
+// once full.
+type messageRing struct {
+	messages []*Message
+	next     int // Index the next message is written to
+	full     bool
+}
+
+// NewMemoryChatStore creates a store keeping the given number of messages per
+// room, or a default number if size is not positive.
+func NewMemoryChatStore(size int) *MemoryChatStore {
+	if size <= 0 {
+		size = defaultMemoryStoreSize
+	}
+	return &MemoryChatStore{
+		size:  size,
+		rooms: make(map[string]*messageRing),
+	}
+}
+
+func (s *MemoryChatStore) Append(message *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rooms[message.RoomID]
+	if !ok {
+		ring = &messageRing{messages: make([]*Message, s.size)}
+		s.rooms[message.RoomID] = ring
+	}
+
+	ring.messages[ring.next] = message
+	ring.next = (ring.next + 1) % len(ring.messages)
+	if ring.next == 0 {
+		ring.full = true
+	}
+	return nil
+}
+
+func (s *MemoryChatStore) History(roomID, beforeID string, limit int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.rooms[roomID]
+	if !ok {
+		return nil, nil
+	}
+
+	messages := ring.ordered()
+	end := len(messages)
+	if beforeID != "" {
+		end = -1
+		for i, message := range messages {
+			if message.ID == beforeID {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, nil
+		}
+	}
+
+	start := 0
+	if limit > 0 && end-limit > start {
+		start = end - limit
+	}
+	return append([]*Message(nil), messages[start:end]...), nil
+}
+
+func (s *MemoryChatStore) Get(roomID, messageID string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ring, ok := s.rooms[roomID]; ok {
+		for _, message := range ring.messages {
+			if message != nil && message.ID == messageID {
+				return message, nil
+			}
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (s *MemoryChatStore) Delete(roomID, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+
+	for i, message := range ring.messages {
+		if message != nil && message.ID == messageID {
+			ring.messages[i] = tombstone(message)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *MemoryChatStore) Update(roomID, messageID string, update func(*Message) error) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rooms[roomID]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+
+	for i, message := range ring.messages {
+		if message == nil || message.ID != messageID {
+			continue
+		}
+		// The stored message may be read by callers of History, it is
+		// replaced rather than changed
+		updated := cloneMessage(message)
+		if err := update(updated); err != nil {
+			return nil, err
+		}
+		ring.messages[i] = updated
+		return updated, nil
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (s *MemoryChatStore) CloseRoom(roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, roomID)
+	return nil
+}
+
+func (s *MemoryChatStore) Close() error {
+	return nil
+}
+
+// ordered returns the messages of the ring from the oldest to the newest.
+func (r *messageRing) ordered() []*Message {
+	if !r.full {
+		return r.messages[:r.next]
+	}
+	return append(append([]*Message(nil), r.messages[r.next:]...), r.messages[:r.next]...)
+}
+
+// cloneMessage returns a copy of a message that can be changed without
+// affecting the original.
+func cloneMessage(message *Message) *Message {
+	clone := *message
+	if message.Reactions != nil {
+		clone.Reactions = make(map[string][]string, len(message.Reactions))
+		for reaction, userIDs := range message.Reactions {
+			clone.Reactions[reaction] = append([]string(nil), userIDs...)
+		}
+	}
+	clone.Edits = append([]MessageRevision(nil), message.Edits...)
+	return &clone
+}
+
+// tombstone returns a copy of a deleted message without its content.
+func tombstone(message *Message) *Message {
+	deleted := *message
+	deleted.Text = ""
+	deleted.Edits = nil
+	deleted.Reactions = nil
+	deleted.Deleted = true
+	return &deleted
+}
@@ -0,0 +1,210 @@
+package customchat
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltChatStore is a ChatStore persisting every message in a bbolt database
+// file. Each room has a bucket of messages keyed by a sequence number and a
+// bucket mapping message IDs to their sequence number.
+type BoltChatStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltMessagesBucket = []byte("messages")
+	boltIDsBucket      = []byte("ids")
+)
+
+// OpenBoltChatStore opens or creates the database file at path.
+func OpenBoltChatStore(path string) (*BoltChatStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltChatStore{db: db}, nil
+}
+
+func (s *BoltChatStore) Append(message *Message) error {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		room, err := tx.CreateBucketIfNotExists([]byte(message.RoomID))
+		if err != nil {
+			return err
+		}
+		messages, err := room.CreateBucketIfNotExists(boltMessagesBucket)
+		if err != nil {
+			return err
+		}
+		ids, err := room.CreateBucketIfNotExists(boltIDsBucket)
+		if err != nil {
+			return err
+		}
+
+		seq, err := messages.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := boltKey(seq)
+
+		if err := messages.Put(key, raw); err != nil {
+			return err
+		}
+		return ids.Put([]byte(message.ID), key)
+	})
+}
+
+func (s *BoltChatStore) History(roomID, beforeID string, limit int) ([]*Message, error) {
+	var messages []*Message
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		room := tx.Bucket([]byte(roomID))
+		if room == nil {
+			return nil
+		}
+
+		cursor := room.Bucket(boltMessagesBucket).Cursor()
+		var key, value []byte
+		if beforeID == "" {
+			key, value = cursor.Last()
+		} else {
+			before := room.Bucket(boltIDsBucket).Get([]byte(beforeID))
+			if before == nil {
+				return nil
+			}
+			cursor.Seek(before)
+			key, value = cursor.Prev()
+		}
+
+		for ; key != nil && (limit <= 0 || len(messages) < limit); key, value = cursor.Prev() {
+			message := &Message{}
+			if err := json.Unmarshal(value, message); err != nil {
+				return err
+			}
+			messages = append(messages, message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The cursor walked from the newest message backwards
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *BoltChatStore) Get(roomID, messageID string) (*Message, error) {
+	message := &Message{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		room := tx.Bucket([]byte(roomID))
+		if room == nil {
+			return ErrMessageNotFound
+		}
+
+		key := room.Bucket(boltIDsBucket).Get([]byte(messageID))
+		if key == nil {
+			return ErrMessageNotFound
+		}
+		return json.Unmarshal(room.Bucket(boltMessagesBucket).Get(key), message)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (s *BoltChatStore) Delete(roomID, messageID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		room := tx.Bucket([]byte(roomID))
+		if room == nil {
+			return nil
+		}
+
+		key := room.Bucket(boltIDsBucket).Get([]byte(messageID))
+		if key == nil {
+			return nil
+		}
+
+		messages := room.Bucket(boltMessagesBucket)
+		message := &Message{}
+		if err := json.Unmarshal(messages.Get(key), message); err != nil {
+			return err
+		}
+
+		raw, err := json.Marshal(tombstone(message))
+		if err != nil {
+			return err
+		}
+		return messages.Put(key, raw)
+	})
+}
+
+func (s *BoltChatStore) Update(roomID, messageID string, update func(*Message) error) (*Message, error) {
+	var updated *Message
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		room := tx.Bucket([]byte(roomID))
+		if room == nil {
+			return ErrMessageNotFound
+		}
+
+		key := room.Bucket(boltIDsBucket).Get([]byte(messageID))
+		if key == nil {
+			return ErrMessageNotFound
+		}
+
+		messages := room.Bucket(boltMessagesBucket)
+		message := &Message{}
+		if err := json.Unmarshal(messages.Get(key), message); err != nil {
+			return err
+		}
+		if err := update(message); err != nil {
+			return err
+		}
+
+		raw, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		updated = message
+		return messages.Put(key, raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// CloseRoom deletes the history of the room, as the memory store does, so a
+// room opened later with the same ID does not replay it.
+func (s *BoltChatStore) CloseRoom(roomID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(roomID))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *BoltChatStore) Close() error {
+	return s.db.Close()
+}
+
+func boltKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,200 @@
+package customchat
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// appendMessages appends the messages "1" to "n" to the room.
+func appendMessages(t *testing.T, store ChatStore, roomID string, n int) {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		if err := store.Append(&Message{ID: strconv.Itoa(i), RoomID: roomID, Type: MessageText}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func messageIDs(messages []*Message) []string {
+	ids := []string{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	return ids
+}
+
+func TestChatStoreHistory(t *testing.T) {
+	stores := map[string]func(t *testing.T) ChatStore{
+		"memory": func(*testing.T) ChatStore { return NewMemoryChatStore(10) },
+		"bolt": func(t *testing.T) ChatStore {
+			store, err := OpenBoltChatStore(filepath.Join(t.TempDir(), "chat.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	}
+
+	tests := []struct {
+		name     string
+		messages int
+		roomID   string
+		beforeID string
+		limit    int
+		want     []string
+	}{
+		{
+			name:     "every message",
+			messages: 3,
+			want:     []string{"1", "2", "3"},
+		},
+		{
+			name:     "latest page",
+			messages: 5,
+			limit:    2,
+			want:     []string{"4", "5"},
+		},
+		{
+			name:     "page before a message",
+			messages: 5,
+			beforeID: "4",
+			limit:    2,
+			want:     []string{"2", "3"},
+		},
+		{
+			name:     "short last page",
+			messages: 5,
+			beforeID: "2",
+			limit:    2,
+			want:     []string{"1"},
+		},
+		{
+			name:     "nothing before the first message",
+			messages: 5,
+			beforeID: "1",
+			want:     []string{},
+		},
+		{
+			name:     "unknown message",
+			messages: 5,
+			beforeID: "missing",
+			want:     []string{},
+		},
+		{
+			name:     "unknown room",
+			messages: 5,
+			roomID:   "other",
+			want:     []string{},
+		},
+	}
+
+	for storeName, newStore := range stores {
+		for _, test := range tests {
+			t.Run(storeName+"/"+test.name, func(t *testing.T) {
+				store := newStore(t)
+				appendMessages(t, store, "room", test.messages)
+
+				roomID := test.roomID
+				if roomID == "" {
+					roomID = "room"
+				}
+				messages, err := store.History(roomID, test.beforeID, test.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := messageIDs(messages); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("History() = %v, want %v", got, test.want)
+				}
+			})
+		}
+
+		t.Run(storeName+"/close room", func(t *testing.T) {
+			store := newStore(t)
+			appendMessages(t, store, "room", 3)
+			appendMessages(t, store, "other", 1)
+
+			if err := store.CloseRoom("room"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CloseRoom("unknown"); err != nil {
+				t.Fatalf("CloseRoom() of an unknown room error = %v", err)
+			}
+
+			messages, err := store.History("room", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 0 {
+				t.Errorf("History() after CloseRoom() = %v, want none", messageIDs(messages))
+			}
+			if messages, err := store.History("other", "", 0); err != nil || len(messages) != 1 {
+				t.Errorf("History() of another room = %v, %v, want its message", messageIDs(messages), err)
+			}
+		})
+	}
+}
+
+func TestMemoryChatStoreEviction(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+		beforeID string
+		want     []string
+		evicted  string
+	}{
+		{
+			name:     "not full",
+			messages: 2,
+			want:     []string{"1", "2"},
+		},
+		{
+			name:     "full",
+			messages: 3,
+			want:     []string{"1", "2", "3"},
+		},
+		{
+			name:     "oldest overwritten",
+			messages: 5,
+			want:     []string{"3", "4", "5"},
+			evicted:  "2",
+		},
+		{
+			name:     "page before a message after wrapping",
+			messages: 5,
+			beforeID: "5",
+			want:     []string{"3", "4"},
+			evicted:  "1",
+		},
+		{
+			name:     "evicted message",
+			messages: 5,
+			beforeID: "2",
+			want:     []string{},
+			evicted:  "2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryChatStore(3)
+			appendMessages(t, store, "room", test.messages)
+
+			messages, err := store.History("room", test.beforeID, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := messageIDs(messages); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("History() = %v, want %v", got, test.want)
+			}
+			if test.evicted != "" {
+				if _, err := store.Get("room", test.evicted); err != ErrMessageNotFound {
+					t.Errorf("Get() of an evicted message error = %v, want %v", err, ErrMessageNotFound)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package customchat
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxReactionSize = 32 // Bytes of a reaction
+	maxReactions    = 20 // Different reactions on a message
+	maxEdits        = 10 // Previous texts kept in the edit history of a message
+)
+
+// errForbidden rejects a change the client may not make, the error text is
+// sent to the client.
+type errForbidden string
+
+func (e errForbidden) Error() string {
+	return string(e)
+}
+
+// publishReply publishes a text message of a client, checking that the
+// message it replies to exists.
+func (h *CustomHub) publishReply(client *CustomClient, text clientMessage) {
+	message := h.newClientMessage(client, MessageText, strings.TrimPrefix(text.Text, "/"))
+	if text.ReplyTo != "" {
+		if h.Store != nil {
+			if _, err := h.Store.Get(h.RoomID, text.ReplyTo); err != nil {
+				h.rejectUpdate(client, err)
+				return
+			}
+		}
+		message.ReplyTo = text.ReplyTo
+	}
+	h.stopTyping(client)
+	h.publishMessage(message)
+}
+
+// react adds or removes a reaction of a client on a stored message and sends
+// the new reactions of the message to the clients.
+func (h *CustomHub) react(client *CustomClient, reaction clientMessage) {
+	updated, err := h.updateMessage(reaction.MessageID, func(message *Message) error {
+		if message.Deleted {
+			return ErrMessageNotFound
+		}
+		if reaction.Type == MessageReaction {
+			return addReaction(message, reaction.Text, client.ID)
+		}
+		removeReaction(message, reaction.Text, client.ID)
+		return nil
+	})
+	if err != nil {
+		h.rejectUpdate(client, err)
+		return
+	}
+
+	event := h.newClientMessage(client, reaction.Type, reaction.Text)
+	event.MessageID = updated.ID
+	event.Reactions = updated.Reactions
+	h.broadcastMessage(event)
+}
+
+// editMessage replaces the text of a message of the client, keeping the
+// previous text in its edit history. Only the last maxEdits texts are kept.
+func (h *CustomHub) editMessage(client *CustomClient, edit clientMessage) {
+	updated, err := h.updateMessage(edit.MessageID, func(message *Message) error {
+		if message.Deleted {
+			return ErrMessageNotFound
+		}
+		if message.Type != MessageText || message.SenderID != client.ID {
+			return errForbidden("only your own messages can be edited")
+		}
+		message.Edits = append(message.Edits, MessageRevision{Text: message.Text, EditedAt: time.Now().UTC()})
+		if len(message.Edits) > maxEdits {
+			message.Edits = append([]MessageRevision(nil), message.Edits[len(message.Edits)-maxEdits:]...)
+		}
+		message.Text = edit.Text
+		return nil
+	})
+	if err != nil {
+		h.rejectUpdate(client, err)
+		return
+	}
+
+	event := h.newClientMessage(client, MessageEdited, updated.Text)
+	event.MessageID = updated.ID
+	event.Edits = updated.Edits
+	h.broadcastMessage(event)
+}
+
+// updateMessage changes a stored message. Messages can only be changed while
+// they are stored.
+func (h *CustomHub) updateMessage(messageID string, update func(*Message) error) (*Message, error) {
+	if h.Store == nil {
+		return nil, ErrMessageNotFound
+	}
+	return h.Store.Update(h.RoomID, messageID, update)
+}
+
+// rejectUpdate tells a client why its change was not applied.
+func (h *CustomHub) rejectUpdate(client *CustomClient, err error) {
+	var forbidden errForbidden
+	switch {
+	case errors.As(err, &forbidden):
+		h.sendError(client, ErrorForbidden, forbidden.Error())
+	case errors.Is(err, ErrMessageNotFound):
+		h.sendError(client, ErrorNotFound, "the message does not exist")
+	default:
+		log.Printf("error updating message: %v", err)
+		h.sendError(client, ErrorFailed, "the message could not be updated")
+	}
+}
+
+func addReaction(message *Message, reaction, userID string) error {
+	userIDs, ok := message.Reactions[reaction]
+	if !ok && len(message.Reactions) >= maxReactions {
+		return errForbidden("the message has too many different reactions")
+	}
+
+	i := sort.SearchStrings(userIDs, userID)
+	if i < len(userIDs) && userIDs[i] == userID {
+		return nil
+	}
+	userIDs = append(userIDs, "")
+	copy(userIDs[i+1:], userIDs[i:])
+	userIDs[i] = userID
+
+	if message.Reactions == nil {
+		message.Reactions = make(map[string][]string)
+	}
+	message.Reactions[reaction] = userIDs
+	return nil
+}
+
+func removeReaction(message *Message, reaction, userID string) {
+	userIDs := message.Reactions[reaction]
+	i := sort.SearchStrings(userIDs, userID)
+	if i == len(userIDs) || userIDs[i] != userID {
+		return
+	}
+
+	userIDs = append(userIDs[:i], userIDs[i+1:]...)
+	if len(userIDs) > 0 {
+		message.Reactions[reaction] = userIDs
+		return
+	}
+	delete(message.Reactions, reaction)
+	if len(message.Reactions) == 0 {
+		message.Reactions = nil
+	}
+}
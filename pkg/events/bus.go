@@ -0,0 +1,142 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type identifies the kind of an event.
+type Type string
+
+const (
+	RoomCreated       Type = "room.created"
+	RoomClosed        Type = "room.closed"
+	ParticipantJoined Type = "participant.joined" // Data is a webrtc.ParticipantPayload
+	ParticipantLeft   Type = "participant.left"   // Data is a webrtc.ParticipantPayload
+	TrackPublished    Type = "track.published"    // Data is a webrtc.TrackPayload
+	TrackUnpublished  Type = "track.unpublished"  // Data is a webrtc.TrackPayload
+	ChatMessage       Type = "chat.message"       // Data is a *customchat.Message
+)
+
+// DefaultBufferSize is the buffer of a subscription unless given otherwise.
+const DefaultBufferSize = 256
+
+// Event is something that happened in a room. Subscribers share the data of
+// an event and must not modify it.
+type Event struct {
+	Type      Type
+	RoomID    string
+	Timestamp time.Time
+	Data      interface{}
+}
+
+// Filter selects the events of a subscription.
+type Filter struct {
+	RoomID string // Events of this room only, of every room if empty
+	Types  []Type // Events of these types only, of every type if empty
+}
+
+func (f Filter) match(event Event) bool {
+	if f.RoomID != "" && f.RoomID != event.RoomID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, typ := range f.Types {
+		if typ == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus delivers the events published by the rooms to in-process subscribers,
+// such as metrics, webhooks or audit logs. Publishing never blocks: events
+// are dropped for subscribers whose buffer is full. A nil Bus drops every
+// event.
+type Bus struct {
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]bool
+}
+
+// NewBus creates a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{subscriptions: make(map[*Subscription]bool)}
+}
+
+// Subscription receives the events matching its filter until it is
+// unsubscribed.
+type Subscription struct {
+	filter  Filter
+	events  chan Event
+	dropped atomic.Uint64
+}
+
+// Events returns the channel of the events of the subscription. It is closed
+// once the subscription is unsubscribed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns how many events were dropped because the buffer of the
+// subscription was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Subscribe registers a subscription to the events matching filter, buffering
+// up to size events, or DefaultBufferSize if size is not positive.
+func (b *Bus) Subscribe(filter Filter, size int) *Subscription {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	subscription := &Subscription{filter: filter, events: make(chan Event, size)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscriptions[subscription] = true
+	return subscription
+}
+
+// Unsubscribe removes a subscription and closes its channel. Unsubscribing
+// twice does nothing.
+func (b *Bus) Unsubscribe(subscription *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscriptions[subscription] {
+		delete(b.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+// Publish sends an event to the matching subscriptions.
+func (b *Bus) Publish(eventType Type, roomID string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		RoomID:    roomID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for subscription := range b.subscriptions {
+		if !subscription.filter.match(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			subscription.dropped.Add(1)
+		}
+	}
+}
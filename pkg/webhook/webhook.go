@@ -0,0 +1,225 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/events"
+	gguid "github.com/google/uuid"
+)
+
+// Headers of webhook requests. The signature is the hex encoded HMAC-SHA256
+// of the timestamp, a dot and the body, keyed with the shared secret.
+const (
+	HeaderEvent     = "X-Golivesync-Event"
+	HeaderDelivery  = "X-Golivesync-Delivery"
+	HeaderTimestamp = "X-Golivesync-Timestamp"
+	HeaderSignature = "X-Golivesync-Signature"
+)
+
+const (
+	queueSize      = 1024
+	workers        = 4
+	requestTimeout = 10 * time.Second
+	maxAttempts    = 6
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+)
+
+// Event is the JSON body of a webhook request.
+type Event struct {
+	ID        string      `json:"id"`
+	Type      events.Type `json:"type"`
+	RoomID    string      `json:"roomId"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// delivery is an event waiting to be sent.
+type delivery struct {
+	event   Event
+	body    []byte
+	attempt int
+}
+
+// Dispatcher POSTs the events of a bus to a webhook endpoint. Events are
+// queued and sent by background workers, failed deliveries are retried with
+// an exponential backoff.
+type Dispatcher struct {
+	url    string
+	secret []byte
+	client *http.Client
+
+	queue     chan *delivery
+	bus       *events.Bus
+	events    *events.Subscription
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	startOnce sync.Once
+}
+
+// NewDispatcher creates a dispatcher sending every event of bus to the
+// endpoint at url, signing its requests with secret.
+func NewDispatcher(bus *events.Bus, url, secret string) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan *delivery, queueSize),
+		bus:    bus,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start subscribes to the bus and starts the workers sending the events.
+func (d *Dispatcher) Start() {
+	d.startOnce.Do(func() {
+		d.events = d.bus.Subscribe(events.Filter{}, queueSize)
+		d.wg.Add(1)
+		go d.forward()
+
+		for i := 0; i < workers; i++ {
+			d.wg.Add(1)
+			go d.work()
+		}
+	})
+}
+
+// Close unsubscribes from the bus and stops the workers. Events that are
+// still queued or waiting for a retry are dropped.
+func (d *Dispatcher) Close() {
+	if d.events != nil {
+		d.bus.Unsubscribe(d.events)
+	}
+	d.cancel()
+	d.wg.Wait()
+}
+
+// forward queues the events of the bus until the subscription ends.
+func (d *Dispatcher) forward() {
+	defer d.wg.Done()
+
+	for event := range d.events.Events() {
+		d.send(event)
+	}
+}
+
+// send queues an event, dropping it if the queue is full.
+func (d *Dispatcher) send(busEvent events.Event) {
+	event := Event{
+		ID:        gguid.New().String(),
+		Type:      busEvent.Type,
+		RoomID:    busEvent.RoomID,
+		Timestamp: busEvent.Timestamp,
+		Data:      busEvent.Data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error encoding webhook event: %v", err)
+		return
+	}
+	d.enqueue(&delivery{event: event, body: body})
+}
+
+func (d *Dispatcher) enqueue(delivery *delivery) {
+	select {
+	case d.queue <- delivery:
+	case <-d.ctx.Done():
+	default:
+		log.Printf("webhook queue is full, dropping %s event %s", delivery.event.Type, delivery.event.ID)
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case delivery := <-d.queue:
+			d.deliver(delivery)
+		}
+	}
+}
+
+// deliver sends an event and schedules a retry if it failed.
+func (d *Dispatcher) deliver(delivery *delivery) {
+	delivery.attempt++
+	retry, err := d.post(delivery)
+	if err == nil {
+		return
+	}
+
+	if !retry || delivery.attempt >= maxAttempts {
+		log.Printf("error delivering webhook %s event %s, giving up: %v", delivery.event.Type, delivery.event.ID, err)
+		return
+	}
+
+	delay := retryDelay(delivery.attempt)
+	log.Printf("error delivering webhook %s event %s, retrying in %s: %v", delivery.event.Type, delivery.event.ID, delay, err)
+	time.AfterFunc(delay, func() { d.enqueue(delivery) })
+}
+
+// post sends an event once. It reports whether a failed request is worth
+// retrying: client errors other than timeouts and rate limiting are not.
+func (d *Dispatcher) post(delivery *delivery) (bool, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, d.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(delivery.event.Type))
+	req.Header.Set(HeaderDelivery, delivery.event.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(d.secret, timestamp, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+}
+
+// Sign returns the signature of a webhook request, for receivers to compare
+// with the signature header.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay returns the delay before the retry following the given attempt.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay
+}
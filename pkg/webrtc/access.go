@@ -0,0 +1,171 @@
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RoomOptions are chosen when a room is created and cannot change afterwards.
+type RoomOptions struct {
+	Password   string // Required to enter the room, empty for none
+	InviteOnly bool   // The room is entered with a one-time invite code only
+}
+
+const (
+	inviteTTL           = 7 * 24 * time.Hour // Invite codes not redeemed for this long expire
+	admissionTTL        = 7 * 24 * time.Hour // Users not seen for this long must enter the room again
+	accessSweepInterval = time.Hour          // Interval at which expired invites and admissions are dropped
+)
+
+// RoomAccess holds the secrets of a room: the random key of its stream link,
+// the hash of its password, its pending invite codes and the users who
+// entered it. Rooms created without a password or invites are public.
+type RoomAccess struct {
+	StreamKey string // Alias of the room in the stream routes
+
+	passwordHash []byte
+	inviteOnly   bool
+
+	mu        sync.Mutex
+	invites   map[string]time.Time // Expiry, keyed by code
+	admitted  map[string]time.Time // Expiry, keyed by user ID
+	nextSweep time.Time
+}
+
+func newRoomAccess(options RoomOptions) (*RoomAccess, error) {
+	access := &RoomAccess{
+		StreamKey:  randomKey(32),
+		inviteOnly: options.InviteOnly,
+		invites:    make(map[string]time.Time),
+		admitted:   make(map[string]time.Time),
+	}
+
+	if options.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(options.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		access.passwordHash = hash
+	}
+	return access, nil
+}
+
+// randomKey returns n random bytes, hex encoded.
+func randomKey(n int) string {
+	key := make([]byte, n)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// Protected reports whether entering the room needs a password or an invite.
+func (a *RoomAccess) Protected() bool {
+	return a.passwordHash != nil || a.inviteOnly
+}
+
+// HasPassword reports whether the room has a password.
+func (a *RoomAccess) HasPassword() bool {
+	return a.passwordHash != nil
+}
+
+// InviteOnly reports whether the room is entered with invite codes only.
+func (a *RoomAccess) InviteOnly() bool {
+	return a.inviteOnly
+}
+
+// CheckPassword reports whether password is the password of the room.
+func (a *RoomAccess) CheckPassword(password string) bool {
+	return a.passwordHash == nil || bcrypt.CompareHashAndPassword(a.passwordHash, []byte(password)) == nil
+}
+
+// NewInvite creates an invite code that lets one user enter the room until
+// it expires.
+func (a *RoomAccess) NewInvite() string {
+	code := randomKey(16)
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(now)
+	a.invites[code] = now.Add(inviteTTL)
+	return code
+}
+
+// RedeemInvite uses up an invite code and reports whether it was valid.
+func (a *RoomAccess) RedeemInvite(code string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expiry, ok := a.invites[code]
+	if !ok {
+		return false
+	}
+	delete(a.invites, code)
+	return time.Now().Before(expiry)
+}
+
+// Admit lets a user into the room, also after it closed and opened again.
+// The admission lapses once the user is not seen for a while.
+func (a *RoomAccess) Admit(userID string) {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(now)
+	a.admitted[userID] = now.Add(admissionTTL)
+}
+
+// Revoke forgets the admission of a user, such as a WHIP or WHEP session that
+// ended.
+func (a *RoomAccess) Revoke(userID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.admitted, userID)
+}
+
+// Admitted reports whether a user may enter the room without a password or
+// an invite, extending its admission if so.
+func (a *RoomAccess) Admitted(userID string) bool {
+	if !a.Protected() {
+		return true
+	}
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expiry, ok := a.admitted[userID]
+	if !ok || !now.Before(expiry) {
+		return false
+	}
+	a.admitted[userID] = now.Add(admissionTTL)
+	return true
+}
+
+// sweep drops the expired invites and admissions, once per sweep interval.
+// The caller must hold the lock.
+func (a *RoomAccess) sweep(now time.Time) {
+	if now.Before(a.nextSweep) {
+		return
+	}
+	a.nextSweep = now.Add(accessSweepInterval)
+
+	for code, expiry := range a.invites {
+		if !now.Before(expiry) {
+			delete(a.invites, code)
+		}
+	}
+	for userID, expiry := range a.admitted {
+		if !now.Before(expiry) {
+			delete(a.admitted, userID)
+		}
+	}
+}
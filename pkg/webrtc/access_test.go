@@ -0,0 +1,195 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomAccessPassword(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   RoomOptions
+		password  string
+		protected bool
+		want      bool
+	}{
+		{
+			name: "public",
+			want: true,
+		},
+		{
+			name:      "right password",
+			options:   RoomOptions{Password: "secret"},
+			password:  "secret",
+			protected: true,
+			want:      true,
+		},
+		{
+			name:      "wrong password",
+			options:   RoomOptions{Password: "secret"},
+			password:  "guess",
+			protected: true,
+		},
+		{
+			name:      "missing password",
+			options:   RoomOptions{Password: "secret"},
+			protected: true,
+		},
+		{
+			name:      "invite only",
+			options:   RoomOptions{InviteOnly: true},
+			protected: true,
+			want:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access, err := newRoomAccess(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := access.Protected(); got != test.protected {
+				t.Errorf("Protected() = %v, want %v", got, test.protected)
+			}
+			if got := access.CheckPassword(test.password); got != test.want {
+				t.Errorf("CheckPassword(%q) = %v, want %v", test.password, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoomAccessInvites(t *testing.T) {
+	tests := []struct {
+		name   string
+		redeem func(access *RoomAccess, code string) string // Returns the code to redeem
+		want   bool
+	}{
+		{
+			name:   "valid",
+			redeem: func(_ *RoomAccess, code string) string { return code },
+			want:   true,
+		},
+		{
+			name:   "unknown",
+			redeem: func(*RoomAccess, string) string { return "unknown" },
+		},
+		{
+			name: "used up",
+			redeem: func(access *RoomAccess, code string) string {
+				access.RedeemInvite(code)
+				return code
+			},
+		},
+		{
+			name: "expired",
+			redeem: func(access *RoomAccess, code string) string {
+				access.invites[code] = time.Now().Add(-time.Second)
+				return code
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access, err := newRoomAccess(RoomOptions{InviteOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code := test.redeem(access, access.NewInvite())
+			if got := access.RedeemInvite(code); got != test.want {
+				t.Errorf("RedeemInvite() = %v, want %v", got, test.want)
+			}
+			if _, ok := access.invites[code]; ok {
+				t.Error("the invite was kept after it was redeemed")
+			}
+		})
+	}
+}
+
+func TestRoomAccessAdmissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options RoomOptions
+		admit   func(access *RoomAccess)
+		want    bool
+	}{
+		{
+			name:    "public",
+			options: RoomOptions{},
+			admit:   func(*RoomAccess) {},
+			want:    true,
+		},
+		{
+			name:    "not admitted",
+			options: RoomOptions{InviteOnly: true},
+			admit:   func(*RoomAccess) {},
+		},
+		{
+			name:    "admitted",
+			options: RoomOptions{InviteOnly: true},
+			admit:   func(access *RoomAccess) { access.Admit("alice") },
+			want:    true,
+		},
+		{
+			name:    "revoked",
+			options: RoomOptions{InviteOnly: true},
+			admit: func(access *RoomAccess) {
+				access.Admit("alice")
+				access.Revoke("alice")
+			},
+		},
+		{
+			name:    "expired",
+			options: RoomOptions{InviteOnly: true},
+			admit: func(access *RoomAccess) {
+				access.Admit("alice")
+				access.admitted["alice"] = time.Now().Add(-time.Second)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access, err := newRoomAccess(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.admit(access)
+			if got := access.Admitted("alice"); got != test.want {
+				t.Errorf("Admitted() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoomAccessSweep(t *testing.T) {
+	access, err := newRoomAccess(RoomOptions{InviteOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	access.invites["expired"] = now.Add(-time.Second)
+	access.invites["pending"] = now.Add(time.Hour)
+	access.admitted["gone"] = now.Add(-time.Second)
+	access.admitted["alice"] = now.Add(time.Hour)
+
+	access.sweep(now)
+
+	if _, ok := access.invites["expired"]; ok {
+		t.Error("an expired invite was kept")
+	}
+	if _, ok := access.invites["pending"]; !ok {
+		t.Error("a pending invite was dropped")
+	}
+	if _, ok := access.admitted["gone"]; ok {
+		t.Error("an expired admission was kept")
+	}
+	if _, ok := access.admitted["alice"]; !ok {
+		t.Error("a current admission was dropped")
+	}
+}
@@ -0,0 +1,249 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// downTrackQueueSize bounds the packets waiting to be written to a
+// subscriber. Packets arriving on a full queue are dropped, so a slow
+// subscriber never stalls the publisher or the other subscribers.
+const downTrackQueueSize = 512
+
+// DownTrack forwards one published track to one subscriber. It picks the
+// simulcast layer the subscriber receives and rewrites sequence numbers and
+// timestamps, so that a layer switch or a pause looks like one continuous
+// stream. The SSRC is rewritten by the TrackLocalStaticRTP it writes to.
+// Packets are written by a goroutine of the down-track from a bounded queue.
+type DownTrack struct {
+	SubscriberID string
+
+	router *TrackRouter
+	track  *webrtc.TrackLocalStaticRTP
+
+	queue     chan *rtp.Packet
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	preferred    Layer  // Highest layer requested by the subscriber
+	bandwidth    uint64 // Estimated bandwidth of the subscriber, 0 if unknown
+	targetRID    string // Layer to switch to on its next keyframe
+	currentRID   string // Layer being forwarded
+	forwarding   bool   // Whether currentRID is being forwarded
+	started      bool   // Whether any packet has been forwarded
+	paused       bool
+	needKeyframe bool // Wait for a keyframe before forwarding again
+
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+func newDownTrack(router *TrackRouter, subscriberID string) (*DownTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(router.Codec, router.ID, router.StreamID)
+	if err != nil {
+		return nil, err
+	}
+
+	downTrack := &DownTrack{
+		SubscriberID: subscriberID,
+		router:       router,
+		track:        track,
+		queue:        make(chan *rtp.Packet, downTrackQueueSize),
+		done:         make(chan struct{}),
+		preferred:    LayerHigh,
+	}
+	go downTrack.writeLoop()
+
+	return downTrack, nil
+}
+
+// close stops the writer goroutine. Packets still queued are discarded.
+func (d *DownTrack) close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+}
+
+func (d *DownTrack) writeLoop() {
+	for {
+		select {
+		case packet := <-d.queue:
+			// Writes fail while the track is not bound, the packet is dropped then
+			_ = d.track.WriteRTP(packet)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Pause stops forwarding the track to the subscriber.
+func (d *DownTrack) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.paused = true
+	d.forwarding = false
+}
+
+// Resume forwards the track again, starting with the next keyframe.
+func (d *DownTrack) Resume() {
+	d.mu.Lock()
+	if !d.paused {
+		d.mu.Unlock()
+		return
+	}
+	d.paused = false
+	d.needKeyframe = true
+	d.mu.Unlock()
+
+	d.requestKeyframe()
+}
+
+// Paused reports whether forwarding is paused.
+func (d *DownTrack) Paused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.paused
+}
+
+// TrackLocal returns the track to add to the subscriber's peer connection.
+func (d *DownTrack) TrackLocal() webrtc.TrackLocal {
+	return d.track
+}
+
+// SetPreferredLayer sets the highest layer the subscriber wants to receive.
+func (d *DownTrack) SetPreferredLayer(layer Layer) {
+	d.mu.Lock()
+	d.preferred = layer
+	d.mu.Unlock()
+
+	d.updateTarget()
+}
+
+// SetBandwidth updates the bandwidth estimate of the subscriber in bits per
+// second.
+func (d *DownTrack) SetBandwidth(bandwidth uint64) {
+	d.mu.Lock()
+	d.bandwidth = bandwidth
+	d.mu.Unlock()
+
+	d.updateTarget()
+}
+
+// updateTarget selects the layer for the subscriber and, if it changes, asks
+// the publisher for a keyframe to switch on.
+func (d *DownTrack) updateTarget() {
+	d.mu.Lock()
+	preferred, bandwidth := d.preferred, d.bandwidth
+	d.mu.Unlock()
+
+	target := d.router.selectLayer(preferred, bandwidth)
+
+	d.mu.Lock()
+	switching := target != d.targetRID && (target != d.currentRID || !d.forwarding) && !d.paused
+	d.targetRID = target
+	d.mu.Unlock()
+
+	if switching {
+		d.router.requestLayerKeyframe(target)
+	}
+}
+
+// requestKeyframe asks the publisher for a keyframe on the layer the
+// subscriber receives.
+func (d *DownTrack) requestKeyframe() {
+	d.mu.Lock()
+	rid := d.currentRID
+	if !d.forwarding {
+		rid = d.targetRID
+	}
+	d.mu.Unlock()
+
+	d.router.requestLayerKeyframe(rid)
+}
+
+// writeRTP queues a packet of the given layer if it is the layer the
+// subscriber receives. A switch to the target layer happens on a keyframe,
+// except for tracks that are not simulcast.
+func (d *DownTrack) writeRTP(rid string, packet *rtp.Packet) {
+	d.mu.Lock()
+	if d.paused {
+		d.mu.Unlock()
+		return
+	}
+
+	if !d.forwarding || rid != d.currentRID {
+		waitKeyframe := rid != "" || d.needKeyframe
+		if rid != d.targetRID || (waitKeyframe && !isKeyframe(d.router.Codec.MimeType, packet.Payload)) {
+			d.mu.Unlock()
+			return
+		}
+		d.switchLayer(rid, packet)
+	}
+
+	out := *packet
+	out.SequenceNumber = packet.SequenceNumber + d.seqOffset
+	out.Timestamp = packet.Timestamp + d.tsOffset
+
+	d.lastSeq = out.SequenceNumber
+	d.lastTS = out.Timestamp
+	d.lastWrite = time.Now()
+	d.mu.Unlock()
+
+	select {
+	case d.queue <- &out:
+	default:
+	}
+}
+
+// switchLayer starts forwarding a layer. The offsets continue the sequence
+// numbers and timestamps of the last forwarded packet, advancing the
+// timestamp by the time that passed since then. The caller must hold the
+// lock.
+func (d *DownTrack) switchLayer(rid string, packet *rtp.Packet) {
+	if d.started {
+		elapsed := time.Since(d.lastWrite)
+		tsDelta := uint32(uint64(elapsed) * uint64(d.router.Codec.ClockRate) / uint64(time.Second))
+		if tsDelta == 0 {
+			tsDelta = 1
+		}
+
+		d.seqOffset = d.lastSeq + 1 - packet.SequenceNumber
+		d.tsOffset = d.lastTS + tsDelta - packet.Timestamp
+	}
+
+	d.currentRID = rid
+	d.forwarding = true
+	d.started = true
+	d.needKeyframe = false
+}
+
+// readRTCP reads the RTCP the subscriber sends for the track until the
+// sender is stopped. Keyframe requests are passed to the publisher and
+// bandwidth estimates drive the layer selection.
+func (d *DownTrack) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch pkt := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				d.requestKeyframe()
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				d.SetBandwidth(uint64(pkt.Bitrate))
+			}
+		}
+	}
+}
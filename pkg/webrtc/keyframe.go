@@ -0,0 +1,18 @@
+package webrtc
+
+import "time"
+
+// keyframeRequestInterval throttles the PLIs sent to a publisher, so a burst
+// of joining subscribers results in a single keyframe.
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// RequestKeyframe asks the publisher of a track for a new keyframe.
+func (p *CustomPeerManager) RequestKeyframe(trackID string) {
+	p.ListLock.RLock()
+	router, ok := p.Tracks[trackID]
+	p.ListLock.RUnlock()
+
+	if ok {
+		router.RequestKeyframe()
+	}
+}
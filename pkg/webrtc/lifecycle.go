@@ -0,0 +1,236 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/events"
+	"github.com/gofiber/websocket/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// RoomState is the lifecycle state of a room.
+type RoomState int
+
+const (
+	RoomStateCreated  RoomState = iota // No peer has joined yet
+	RoomStateActive                    // At least one peer is connected
+	RoomStateDraining                  // The last peer left, the idle timeout is running
+	RoomStateClosed                    // Peers and chat are shut down, the room is unusable
+)
+
+const (
+	// DefaultRoomIdleTimeout is how long a room without peers is kept before
+	// it is closed, unless configured otherwise.
+	DefaultRoomIdleTimeout = 5 * time.Minute
+
+	// roomClosedReason is sent to the websockets still open when a room
+	// closes.
+	roomClosedReason = "room closed"
+)
+
+var ErrRoomClosed = errors.New("room is closed")
+
+func (s RoomState) String() string {
+	switch s {
+	case RoomStateCreated:
+		return "created"
+	case RoomStateActive:
+		return "active"
+	case RoomStateDraining:
+		return "draining"
+	case RoomStateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the lifecycle state of the room.
+func (r *CustomRoomManager) State() RoomState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state
+}
+
+// Done returns a channel that is closed when the room closes.
+func (r *CustomRoomManager) Done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// Join counts a peer or chat client connected to the room and stops the idle
+// timeout.
+func (r *CustomRoomManager) Join() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == RoomStateClosed {
+		return ErrRoomClosed
+	}
+
+	r.members++
+	r.state = RoomStateActive
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	return nil
+}
+
+// Leave uncounts a peer or chat client. When the last one leaves the room starts draining
+// and closes once it stayed empty for the idle timeout.
+func (r *CustomRoomManager) Leave() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == RoomStateClosed || r.members == 0 {
+		return
+	}
+
+	r.members--
+	if r.members == 0 {
+		r.state = RoomStateDraining
+		r.startIdleTimer()
+	}
+}
+
+// startIdleTimer schedules the room to close after the idle timeout. The
+// caller must hold the lock.
+func (r *CustomRoomManager) startIdleTimer() {
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+	}
+	r.idleTimer = time.AfterFunc(r.idleTimeout, r.closeIfIdle)
+}
+
+// closeIfIdle closes the room if nobody joined it since the idle timer
+// started. The check and the closing happen under the same lock, so a peer
+// cannot join in between.
+func (r *CustomRoomManager) closeIfIdle() {
+	r.mu.Lock()
+	idle := r.members == 0 && (r.state == RoomStateCreated || r.state == RoomStateDraining)
+	closed := idle && r.closeLocked()
+	r.mu.Unlock()
+
+	if closed {
+		r.shutdown()
+	}
+}
+
+// Close shuts the room down: the remaining peers are told that the room
+// closed and disconnected, and the chat hub is stopped. Closing a closed room
+// does nothing.
+func (r *CustomRoomManager) Close() {
+	r.mu.Lock()
+	closed := r.closeLocked()
+	r.mu.Unlock()
+
+	if closed {
+		r.shutdown()
+	}
+}
+
+// closeLocked marks the room closed and reports whether it was open. The
+// caller must hold the lock and call shutdown after releasing it if so.
+func (r *CustomRoomManager) closeLocked() bool {
+	if r.state == RoomStateClosed {
+		return false
+	}
+	r.state = RoomStateClosed
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	return true
+}
+
+// shutdown releases what a room closed by closeLocked holds.
+func (r *CustomRoomManager) shutdown() {
+	// The hub also stops with the context of the room, stopping it first
+	// tells its clients why
+	r.Hub.Stop(roomClosedReason)
+	r.cancel()
+	r.Peers.close()
+	r.closeChatStore()
+	r.events.Publish(events.RoomClosed, r.ID, nil)
+
+	if r.onClose != nil {
+		r.onClose(r)
+	}
+}
+
+// closeChatStore lets the chat store release the history of the room once
+// the hub stopped writing to it.
+func (r *CustomRoomManager) closeChatStore() {
+	if r.chatStore == nil {
+		return
+	}
+
+	<-r.hubDone
+	if err := r.chatStore.CloseRoom(r.ID); err != nil {
+		log.Printf("Error closing the chat of room %s: %v", r.ID, err)
+	}
+}
+
+// publishEvent publishes an event of the room of the manager, if it belongs
+// to one.
+func (p *CustomPeerManager) publishEvent(eventType events.Type, data interface{}) {
+	if p.room != nil {
+		p.room.events.Publish(eventType, p.room.ID, data)
+	}
+}
+
+// join counts a peer in the room of the manager, if it belongs to one.
+func (p *CustomPeerManager) join() error {
+	if p.room == nil {
+		return nil
+	}
+	return p.room.Join()
+}
+
+func (p *CustomPeerManager) leave() {
+	if p.room != nil {
+		p.room.Leave()
+	}
+}
+
+// close announces that the room closed and disconnects every websocket peer
+// and session. The peers remove themselves once their connection ends.
+func (p *CustomPeerManager) close() {
+	p.ListLock.Lock()
+	p.broadcastSignal(SignalRoomClosed, RoomClosedPayload{Reason: roomClosedReason})
+	connections := append([]CustomPeerConnectionState(nil), p.Connections...)
+	p.ListLock.Unlock()
+
+	for _, connection := range connections {
+		connection.Websocket.close(websocket.CloseGoingAway, roomClosedReason)
+		if err := connection.PeerConnection.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	p.SessionsLock.RLock()
+	sessions := make([]*webrtc.PeerConnection, 0, len(p.Sessions))
+	for _, peerConnection := range p.Sessions {
+		sessions = append(sessions, peerConnection)
+	}
+	p.SessionsLock.RUnlock()
+
+	for _, peerConnection := range sessions {
+		if err := peerConnection.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// close sends a close frame and closes the websocket, ending the read loop of
+// the connection.
+func (t *CustomThreadSafeWriter) close(code int, reason string) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	_ = t.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	_ = t.Conn.Close()
+}
@@ -0,0 +1,55 @@
+package webrtc
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	customAPI     *webrtc.API
+	customAPIErr  error
+	customAPIOnce sync.Once
+)
+
+// simulcastHeaderExtensions are needed to tell the encodings of a simulcast
+// publisher apart.
+var simulcastHeaderExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// newCustomPeerConnection creates a peer connection with the default codecs
+// and interceptors that can also receive simulcast.
+func newCustomPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	customAPIOnce.Do(func() {
+		customAPI, customAPIErr = newCustomAPI()
+	})
+	if customAPIErr != nil {
+		return nil, customAPIErr
+	}
+
+	return customAPI.NewPeerConnection(config)
+}
+
+func newCustomAPI() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	for _, extension := range simulcastHeaderExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
@@ -0,0 +1,139 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/Parthiba-Hazra/golivesync/pkg/auth"
+	"github.com/Parthiba-Hazra/golivesync/pkg/events"
+)
+
+// ErrParticipantExists is returned when a participant joins a room it is
+// already in. Participants with an access token are identified by its
+// subject, so a user is in a room over one connection at a time.
+var ErrParticipantExists = errors.New("participant is already in the room")
+
+// Participant is a member of a room, either a websocket peer or a WHIP
+// publisher. It owns the tracks it publishes, which are removed when it
+// leaves.
+type Participant struct {
+	ID          string
+	DisplayName string
+	Metadata    map[string]string
+	Permissions auth.Permissions // Enforced on the tracks it publishes and receives
+
+	mu      sync.RWMutex
+	tracks  map[string]*TrackRouter
+	sources map[string]string // Declared sources of video tracks, keyed by track ID
+}
+
+// NewParticipant creates a participant without published tracks, with the
+// permissions of a publisher.
+func NewParticipant(id, displayName string, metadata map[string]string) *Participant {
+	return &Participant{
+		ID:          id,
+		DisplayName: displayName,
+		Metadata:    metadata,
+		Permissions: auth.RolePublisher.Permissions(),
+		tracks:      make(map[string]*TrackRouter),
+		sources:     make(map[string]string),
+	}
+}
+
+// PublishedTracks returns the tracks the participant publishes.
+func (p *Participant) PublishedTracks() []*TrackRouter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	routers := make([]*TrackRouter, 0, len(p.tracks))
+	for _, router := range p.tracks {
+		routers = append(routers, router)
+	}
+	return routers
+}
+
+func (p *Participant) addTrack(router *TrackRouter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tracks[router.ID] = router
+}
+
+func (p *Participant) removeTrack(router *TrackRouter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tracks[router.ID] == router {
+		delete(p.tracks, router.ID)
+		delete(p.sources, router.publishedID)
+	}
+}
+
+func (p *Participant) payload() ParticipantPayload {
+	routers := p.PublishedTracks()
+	tracks := make([]TrackPayload, 0, len(routers))
+	for _, router := range routers {
+		tracks = append(tracks, newTrackPayload(router))
+	}
+
+	return ParticipantPayload{
+		ParticipantID: p.ID,
+		DisplayName:   p.DisplayName,
+		Metadata:      p.Metadata,
+		Tracks:        tracks,
+	}
+}
+
+// Participant returns a participant of the room.
+func (p *CustomPeerManager) Participant(participantID string) (*Participant, bool) {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	participant, ok := p.Participants[participantID]
+	return participant, ok
+}
+
+// addParticipant registers a participant and announces it to the peers
+// already in the room, or returns ErrParticipantExists. The caller must hold
+// ListLock.
+func (p *CustomPeerManager) addParticipant(participant *Participant) error {
+	if _, ok := p.Participants[participant.ID]; ok {
+		return ErrParticipantExists
+	}
+
+	p.broadcastSignal(SignalParticipantJoined, participant.payload())
+	p.publishEvent(events.ParticipantJoined, participant.payload())
+	p.Participants[participant.ID] = participant
+	return nil
+}
+
+// removeParticipant unregisters a participant, removes the tracks it
+// published and announces that it left. The caller must hold ListLock.
+func (p *CustomPeerManager) removeParticipant(participantID string) {
+	participant, ok := p.Participants[participantID]
+	if !ok {
+		return
+	}
+	delete(p.Participants, participantID)
+
+	payload := participant.payload()
+	for _, router := range participant.PublishedTracks() {
+		p.removeTrack(router)
+	}
+
+	p.broadcastSignal(SignalParticipantLeft, payload)
+	p.publishEvent(events.ParticipantLeft, payload)
+}
+
+// sendParticipants tells a new peer who is already in the room. The caller
+// must hold ListLock.
+func (p *CustomPeerManager) sendParticipants(connection CustomPeerConnectionState) {
+	for _, participant := range p.Participants {
+		if participant == connection.Participant {
+			continue
+		}
+		if err := connection.Websocket.WriteSignal(SignalParticipantJoined, "", participant.payload()); err != nil {
+			return
+		}
+	}
+}
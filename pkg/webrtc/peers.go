@@ -1,18 +1,28 @@
 package webrtc
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/Parthiba-Hazra/golivesync/pkg/customchat"
+	"github.com/Parthiba-Hazra/golivesync/pkg/events"
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v3"
 )
 
+const (
+	renegotiationBaseDelay = 100 * time.Millisecond // Initial delay before a deferred renegotiation is retried
+	renegotiationMaxDelay  = 5 * time.Second        // Upper bound for the renegotiation backoff
+	renegotiationMaxTries  = 10                     // Failed retries in a row after which a peer is dropped
+)
+
 var (
-	StreamsLock   sync.RWMutex
-	CustomRooms   map[string]*CustomRoomManager
-	CustomStreams map[string]*CustomRoomManager
+	ErrTrackNotFound      = errors.New("track not found")
+	errSignalingNotStable = errors.New("signaling state is not stable")
 )
 
 var (
@@ -34,27 +44,60 @@ var (
 
 // CustomRoomManager manages WebRTC rooms and peers.
 type CustomRoomManager struct {
-	Peers *CustomPeerManager    // Manage peer connections
-	Hub   *customchat.CustomHub // Manage chat messages
+	ID     string
+	Peers  *CustomPeerManager    // Manage peer connections
+	Hub    *customchat.CustomHub // Manage chat messages
+	Access *RoomAccess           // Who may enter the room
+
+	mu          sync.Mutex
+	state       RoomState
+	members     int // Connected websocket peers and sessions
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	ctx         context.Context // Canceled when the room closes
+	cancel      context.CancelFunc
+	hubDone     chan struct{} // Closed once the chat hub stopped
+	chatStore   customchat.ChatStore
+	events      *events.Bus
+	onClose     func(*CustomRoomManager)
 }
 
 // CustomPeerManager manages WebRTC peer connections.
 type CustomPeerManager struct {
-	ListLock    sync.RWMutex
-	Connections []CustomPeerConnectionState // List of peer connections
-	TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+	ListLock     sync.RWMutex
+	Connections  []CustomPeerConnectionState // List of peer connections
+	Tracks       map[string]*TrackRouter     // Published tracks, keyed by track ID
+	Participants map[string]*Participant     // Members of the room, keyed by participant ID
+
+	SessionsLock sync.RWMutex
+	Sessions     map[string]*webrtc.PeerConnection // Peer connections negotiated over HTTP (WHIP/WHEP)
+	publishers   map[string]string                 // Participant IDs of the WHIP sessions, keyed by session ID
+
+	renegotiateLock    sync.Mutex
+	renegotiateTimer   *time.Timer
+	renegotiateAttempt int
+
+	room *CustomRoomManager // Room whose lifecycle counts the peers, if any
 }
 
 // CustomPeerConnectionState holds the state of a WebRTC peer connection.
 type CustomPeerConnectionState struct {
+	Participant    *Participant
 	PeerConnection *webrtc.PeerConnection
 	Websocket      *CustomThreadSafeWriter
+	Subscription   *Subscription // Tracks the peer wants to receive
+
+	renegotiationFailures int  // Retried renegotiations in a row that could not complete
+	offerPending          bool // The senders changed since the last offer sent to the peer
 }
 
 // CustomThreadSafeWriter wraps a websocket connection to provide thread-safe writing.
 type CustomThreadSafeWriter struct {
-	Conn  *websocket.Conn
-	Mutex sync.Mutex
+	Conn    *websocket.Conn
+	Mutex   sync.Mutex
+	Version int // Signaling protocol version negotiated for the connection
+
+	sequence uint64
 }
 
 func (t *CustomThreadSafeWriter) WriteJSON(v interface{}) error {
@@ -63,71 +106,173 @@ func (t *CustomThreadSafeWriter) WriteJSON(v interface{}) error {
 	return t.Conn.WriteJSON(v)
 }
 
-// AddCustomTrack adds a track to the peer connection.
-func (p *CustomPeerManager) AddCustomTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+// AddCustomTrack adds a published track, or another simulcast layer of a
+// track that is already published, and returns the router forwarding it. The
+// receiver is used to request keyframes from the publisher.
+func (p *CustomPeerManager) AddCustomTrack(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, publisher *Participant) *TrackRouter {
 	p.ListLock.Lock()
-	defer func() {
-		p.ListLock.Unlock()
-		p.SignalPeerConnectionHelper()
-	}()
 
-	TrackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
+	trackID := p.routerID(t.ID(), publisher.ID)
+	router, ok := p.Tracks[trackID]
+	if !ok {
+		router = newTrackRouter(trackID, t, publisher.ID)
+		router.Source = publisher.trackSource(t)
+		p.Tracks[trackID] = router
+		publisher.addTrack(router)
+		p.broadcastSignal(SignalTrackAdded, newTrackPayload(router))
+		p.publishEvent(events.TrackPublished, newTrackPayload(router))
+	}
+	router.addLayer(t, receiver)
 
-	if err != nil {
-		log.Printf("custom track local error: %v", err.Error())
-		return nil
+	p.ListLock.Unlock()
+
+	if !ok {
+		p.SignalPeerConnectionHelper()
 	}
-	p.TrackLocals[t.ID()] = TrackLocal
-	return TrackLocal
+	return router
 }
 
-// RemoveCustomTrack removes a track from the peer connection.
-func (p *CustomPeerManager) RemoveCustomTrack(t *webrtc.TrackLocalStaticRTP) {
+// routerID returns the ID a track of a publisher is forwarded under. Clients
+// choose their track IDs, and encoders often use fixed ones, so a track whose
+// ID another participant already publishes is forwarded under the ID prefixed
+// with the ID of its publisher. The caller must hold ListLock.
+func (p *CustomPeerManager) routerID(trackID, publisherID string) string {
+	prefixed := publisherID + ":" + trackID
+	if _, ok := p.Tracks[prefixed]; ok {
+		return prefixed
+	}
+	if router, ok := p.Tracks[trackID]; ok && router.PublisherID != publisherID {
+		return prefixed
+	}
+	return trackID
+}
+
+// RemoveCustomTrack removes a layer of a published track, and the track
+// itself once its last layer is gone.
+func (p *CustomPeerManager) RemoveCustomTrack(router *TrackRouter, rid string) {
+	if !router.removeLayer(rid) {
+		return
+	}
+
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
 		p.SignalPeerConnectionHelper()
 	}()
-	delete(p.TrackLocals, t.ID())
+
+	p.removeTrack(router)
+}
+
+// removeTrack stops forwarding a published track and announces its removal.
+// The caller must hold ListLock.
+func (p *CustomPeerManager) removeTrack(router *TrackRouter) {
+	router.close()
+	if p.Tracks[router.ID] != router {
+		return
+	}
+	delete(p.Tracks, router.ID)
+
+	if publisher, ok := p.Participants[router.PublisherID]; ok {
+		publisher.removeTrack(router)
+	}
+	p.broadcastSignal(SignalTrackRemoved, newTrackPayload(router))
+	p.publishEvent(events.TrackUnpublished, newTrackPayload(router))
 }
 
+// SignalPeerConnectionHelper syncs the tracks of every peer connection with
+// Tracks and sends a fresh offer to the peers whose senders changed. Peers
+// that are in the middle of another negotiation are retried later with an
+// exponential backoff, and dropped once too many retries failed.
 func (p *CustomPeerManager) SignalPeerConnectionHelper() {
+	p.syncPeerConnections(false)
+}
+
+func (p *CustomPeerManager) syncPeerConnections(retry bool) {
 	p.ListLock.Lock()
-	defer func() {
-		p.ListLock.Unlock()
-		p.DispatchCustomKeyFrame()
-	}()
+	defer p.ListLock.Unlock()
+
+	p.removeClosedConnections()
 
+	pending := false
 	for i := range p.Connections {
-		p.handleConnectionSync(&p.Connections[i])
+		connection := &p.Connections[i]
+		if connection.renegotiationFailures >= renegotiationMaxTries {
+			// Dropped, waiting for its peer connection to close
+			continue
+		}
+		if err := p.handleConnectionSync(connection); err != nil {
+			if !errors.Is(err, errSignalingNotStable) {
+				log.Printf("custom renegotiation error: %v", err)
+			}
+			if retry {
+				connection.renegotiationFailures++
+			}
+			if connection.renegotiationFailures >= renegotiationMaxTries {
+				p.dropConnection(connection, err)
+				continue
+			}
+			pending = true
+			continue
+		}
+		connection.renegotiationFailures = 0
 	}
-}
 
-func (p *CustomPeerManager) handleConnectionSync(connection *CustomPeerConnectionState) {
-	if p.shouldRemoveConnection(connection) {
-		p.removeConnection(connection)
-		log.Println("Removed closed connection:", connection)
+	if pending {
+		p.scheduleRenegotiation()
 		return
 	}
+	p.resetRenegotiation()
+}
+
+// handleConnectionSync brings the senders of a connection in line with the
+// tracks it should receive and offers the change to the peer. Connections
+// without changes are left alone, whatever their signaling state.
+func (p *CustomPeerManager) handleConnectionSync(connection *CustomPeerConnectionState) error {
+	unwanted, missing := p.unwantedSenders(connection), p.missingTracks(connection)
+	if len(unwanted) == 0 && len(missing) == 0 && !connection.offerPending {
+		return nil
+	}
+	if connection.PeerConnection.SignalingState() != webrtc.SignalingStateStable {
+		return errSignalingNotStable
+	}
+
+	p.removeSenders(connection, unwanted)
+	for _, trackID := range missing {
+		p.addTrack(connection, trackID)
+	}
+	connection.offerPending = true
+	if len(connection.PeerConnection.GetTransceivers()) == 0 {
+		// Nothing to negotiate yet, such as a viewer in a room without tracks
+		connection.offerPending = false
+		return nil
+	}
 
-	p.syncConnectionTracks(connection)
+	if err := p.sendOffer(connection); err != nil {
+		return err
+	}
+	connection.offerPending = false
+	return nil
 }
 
 func (p *CustomPeerManager) shouldRemoveConnection(connection *CustomPeerConnectionState) bool {
 	return connection.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed
 }
 
-func (p *CustomPeerManager) removeConnection(connection *CustomPeerConnectionState) {
-	p.Connections = removeCustomConnection(p.Connections, connection)
-}
-
-func (p *CustomPeerManager) syncConnectionTracks(connection *CustomPeerConnectionState) {
-	existingSenders := p.collectExistingSenders(connection)
-
-	p.removeUnwantedSenders(connection, existingSenders)
-	p.addMissingSenders(connection, existingSenders)
+func (p *CustomPeerManager) removeClosedConnections() {
+	connections := p.Connections[:0]
+	for i := range p.Connections {
+		if p.shouldRemoveConnection(&p.Connections[i]) {
+			p.unsubscribeAll(p.Connections[i].Participant.ID)
+			p.removeParticipant(p.Connections[i].Participant.ID)
+			continue
+		}
+		connections = append(connections, p.Connections[i])
+	}
+	p.Connections = connections
 }
 
+// collectExistingSenders returns the IDs of the tracks a connection already
+// sends.
 func (p *CustomPeerManager) collectExistingSenders(connection *CustomPeerConnectionState) map[string]bool {
 	existingSenders := make(map[string]bool)
 	for _, senders := range connection.PeerConnection.GetSenders() {
@@ -138,78 +283,290 @@ func (p *CustomPeerManager) collectExistingSenders(connection *CustomPeerConnect
 	return existingSenders
 }
 
-func (p *CustomPeerManager) removeUnwantedSenders(connection *CustomPeerConnectionState, existingSenders map[string]bool) {
-	for _, senders := range connection.PeerConnection.GetSenders() {
-		if senders.Track() == nil {
+// unwantedSenders returns the senders of tracks that are no longer published
+// or that the peer unsubscribed from.
+func (p *CustomPeerManager) unwantedSenders(connection *CustomPeerConnectionState) []*webrtc.RTPSender {
+	var unwanted []*webrtc.RTPSender
+	for _, sender := range connection.PeerConnection.GetSenders() {
+		if sender.Track() == nil {
 			continue
 		}
-		if !existingSenders[senders.Track().ID()] {
-			p.removeSender(connection, senders)
+
+		router, ok := p.Tracks[sender.Track().ID()]
+		if !ok || !connection.Participant.Permissions.Subscribe || !connection.Subscription.Wants(router.ID, router.PublisherID) {
+			unwanted = append(unwanted, sender)
 		}
 	}
+	return unwanted
 }
 
-func (p *CustomPeerManager) removeSender(connection *CustomPeerConnectionState, sender *webrtc.RTPSender) {
-	if err := connection.PeerConnection.RemoveTrack(sender); err != nil {
-		log.Printf("Error removing custom track: %v", err)
+// removeSenders stops sending tracks to a connection.
+func (p *CustomPeerManager) removeSenders(connection *CustomPeerConnectionState, senders []*webrtc.RTPSender) {
+	for _, sender := range senders {
+		trackID := sender.Track().ID()
+		if err := connection.PeerConnection.RemoveTrack(sender); err != nil {
+			log.Printf("Error removing custom track: %v", err)
+		}
+		if router, ok := p.Tracks[trackID]; ok {
+			router.Unsubscribe(connection.Participant.ID)
+		}
 	}
 }
 
-func (p *CustomPeerManager) addMissingSenders(connection *CustomPeerConnectionState, existingSenders map[string]bool) {
-	for trackID := range p.TrackLocals {
-		if !existingSenders[trackID] {
-			p.addTrack(connection, trackID)
+// missingTracks returns the IDs of the published tracks the peer wants but
+// does not receive yet. A publisher never gets its own tracks echoed back.
+func (p *CustomPeerManager) missingTracks(connection *CustomPeerConnectionState) []string {
+	if !connection.Participant.Permissions.Subscribe {
+		return nil
+	}
+
+	existingSenders := p.collectExistingSenders(connection)
+	var missing []string
+	for trackID, router := range p.Tracks {
+		if router.PublisherID == connection.Participant.ID {
+			continue
+		}
+		if !existingSenders[trackID] && connection.Subscription.Wants(trackID, router.PublisherID) {
+			missing = append(missing, trackID)
 		}
 	}
+	return missing
 }
 
+// addTrack subscribes the connection to a track and asks the publisher for a
+// keyframe, so the new subscriber can start decoding right away.
 func (p *CustomPeerManager) addTrack(connection *CustomPeerConnectionState, trackID string) {
-	if _, err := connection.PeerConnection.AddTrack(p.TrackLocals[trackID]); err != nil {
+	if err := subscribeTrack(connection.PeerConnection, p.Tracks[trackID], connection.Participant.ID); err != nil {
 		log.Printf("Error adding custom track: %v", err)
 	}
 }
 
-// DispatchCustomKeyFrame sends a keyframe to all connected peers.
-func (p *CustomPeerManager) DispatchCustomKeyFrame() {
+// subscribeTrack forwards a published track to a peer connection through a
+// new down-track.
+func subscribeTrack(peerConnection *webrtc.PeerConnection, router *TrackRouter, subscriberID string) error {
+	downTrack, err := router.Subscribe(subscriberID)
+	if err != nil {
+		return err
+	}
+
+	sender, err := peerConnection.AddTrack(downTrack.TrackLocal())
+	if err != nil {
+		router.Unsubscribe(subscriberID)
+		return err
+	}
+
+	go downTrack.readRTCP(sender)
+	downTrack.requestKeyframe()
+	return nil
+}
+
+// unsubscribeAll stops forwarding every track to a subscriber. The caller
+// must hold ListLock.
+func (p *CustomPeerManager) unsubscribeAll(subscriberID string) {
+	for _, router := range p.Tracks {
+		router.Unsubscribe(subscriberID)
+	}
+}
+
+// SetPreferredLayer sets the highest simulcast layer a subscriber receives
+// for a track.
+func (p *CustomPeerManager) SetPreferredLayer(subscriberID, trackID string, layer Layer) error {
+	downTrack, err := p.findDownTrack(subscriberID, trackID)
+	if err != nil {
+		return err
+	}
+
+	downTrack.SetPreferredLayer(layer)
+	return nil
+}
+
+// SetTrackPaused pauses or resumes forwarding a track to a subscriber.
+func (p *CustomPeerManager) SetTrackPaused(subscriberID, trackID string, paused bool) error {
+	downTrack, err := p.findDownTrack(subscriberID, trackID)
+	if err != nil {
+		return err
+	}
+
+	if paused {
+		downTrack.Pause()
+	} else {
+		downTrack.Resume()
+	}
+	return nil
+}
+
+func (p *CustomPeerManager) findDownTrack(subscriberID, trackID string) (*DownTrack, error) {
 	p.ListLock.RLock()
-	defer p.ListLock.RUnlock()
+	router, ok := p.Tracks[trackID]
+	p.ListLock.RUnlock()
+	if !ok {
+		return nil, ErrTrackNotFound
+	}
+
+	downTrack, ok := router.DownTrack(subscriberID)
+	if !ok {
+		return nil, ErrTrackNotFound
+	}
+	return downTrack, nil
+}
 
+// sendOffer creates a new offer for the connection, applies it locally and
+// sends it to the peer as a "custom-offer" event.
+func (p *CustomPeerManager) sendOffer(connection *CustomPeerConnectionState) error {
+	offer, err := connection.PeerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err = connection.PeerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	return connection.Websocket.WriteSignal(SignalOffer, "", offer)
+}
+
+// scheduleRenegotiation retries SignalPeerConnectionHelper after a delay that
+// doubles on every consecutive attempt, up to renegotiationMaxDelay.
+func (p *CustomPeerManager) scheduleRenegotiation() {
+	p.renegotiateLock.Lock()
+	defer p.renegotiateLock.Unlock()
+
+	if p.renegotiateTimer != nil {
+		return
+	}
+
+	delay := renegotiationBaseDelay
+	for i := 0; i < p.renegotiateAttempt && delay < renegotiationMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > renegotiationMaxDelay {
+		delay = renegotiationMaxDelay
+	}
+	p.renegotiateAttempt++
+
+	p.renegotiateTimer = time.AfterFunc(delay, func() {
+		p.renegotiateLock.Lock()
+		p.renegotiateTimer = nil
+		p.renegotiateLock.Unlock()
+
+		p.syncPeerConnections(true)
+	})
+}
+
+// dropConnection gives up on a peer whose renegotiations keep failing: the
+// peer is told why and its peer connection is closed, which removes it on the
+// next sync.
+func (p *CustomPeerManager) dropConnection(connection *CustomPeerConnectionState, err error) {
+	log.Printf("custom renegotiation failed %d times, closing peer connection: %v", connection.renegotiationFailures, err)
+	connection.Websocket.writeSignalError("", newSignalingError(ErrorCodeNegotiation, fmt.Errorf("renegotiation failed %d times", connection.renegotiationFailures)))
+
+	go func(peerConnection *webrtc.PeerConnection) {
+		if err := peerConnection.Close(); err != nil {
+			log.Print(err)
+		}
+	}(connection.PeerConnection)
+}
+
+func (p *CustomPeerManager) resetRenegotiation() {
+	p.renegotiateLock.Lock()
+	defer p.renegotiateLock.Unlock()
+
+	p.renegotiateAttempt = 0
+}
+
+// broadcastSignal sends a message to every connected peer. The caller must
+// hold ListLock.
+func (p *CustomPeerManager) broadcastSignal(typ SignalType, payload interface{}) {
 	for i := range p.Connections {
-		p.Connections[i].Websocket.WriteJSON(CustomWebSocketMessage{
-			Event: "custom-keyframe",
-			Data:  "",
-		})
+		if err := p.Connections[i].Websocket.WriteSignal(typ, "", payload); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func newTrackPayload(router *TrackRouter) TrackPayload {
+	return TrackPayload{
+		TrackID:       router.ID,
+		StreamID:      router.StreamID,
+		ParticipantID: router.PublisherID,
+		Kind:          router.Kind.String(),
+		Source:        router.Source,
 	}
 }
 
 // removeCustomConnection removes a connection from the connections list.
 func removeCustomConnection(connections []CustomPeerConnectionState, connection *CustomPeerConnectionState) []CustomPeerConnectionState {
 	for i, conn := range connections {
-		if conn == *connection {
+		if conn.PeerConnection == connection.PeerConnection {
 			return append(connections[:i], connections[i+1:]...)
 		}
 	}
 	return connections
 }
 
-// CustomWebSocketMessage represents a custom WebSocket message structure.
+// CustomWebSocketMessage is the message structure of the legacy signaling
+// protocol, where the JSON payload is carried as a string.
 type CustomWebSocketMessage struct {
 	Event string `json:"event"`
 	Data  string `json:"data"`
 }
 
-// NewCustomRoomManager creates a new CustomRoomManager instance.
-func NewCustomRoomManager() *CustomRoomManager {
-	return &CustomRoomManager{
-		Peers: NewCustomPeerManager(),
-		Hub:   customchat.NewCustomHub(),
+// RoomConfig holds the settings shared by the rooms of a registry.
+type RoomConfig struct {
+	IdleTimeout      time.Duration                 // How long a room without peers is kept
+	ChatStore        customchat.ChatStore          // Chat history of the rooms, nil to keep none
+	ChatFlood        *customchat.FloodPolicy       // Chat rate limits, nil for the defaults
+	ChatSlowConsumer customchat.SlowConsumerPolicy // Applies to chat clients that do not keep up
+	Events           *events.Bus                   // Receives the events of the rooms, nil to publish none
+}
+
+// NewCustomRoomManager creates a new CustomRoomManager instance guarded by
+// access and starts its chat hub. The room closes once it has been without
+// peers for the idle timeout, onClose is called after it closed.
+func NewCustomRoomManager(id string, config RoomConfig, access *RoomAccess, onClose func(*CustomRoomManager)) *CustomRoomManager {
+	room := &CustomRoomManager{
+		ID:          id,
+		Peers:       NewCustomPeerManager(),
+		Hub:         customchat.NewCustomHub(id, config.ChatStore),
+		Access:      access,
+		state:       RoomStateCreated,
+		idleTimeout: config.IdleTimeout,
+		hubDone:     make(chan struct{}),
+		chatStore:   config.ChatStore,
+		events:      config.Events,
+		onClose:     onClose,
+	}
+	room.ctx, room.cancel = context.WithCancel(context.Background())
+	room.Peers.room = room
+	if config.ChatFlood != nil {
+		room.Hub.Flood = *config.ChatFlood
+	}
+	room.Hub.SlowConsumer = config.ChatSlowConsumer
+	if config.Events != nil {
+		room.Hub.OnMessage = func(message *customchat.Message) {
+			config.Events.Publish(events.ChatMessage, id, message)
+		}
 	}
+	go func() {
+		defer close(room.hubDone)
+		room.Hub.Start(room.ctx)
+	}()
+	room.events.Publish(events.RoomCreated, id, nil)
+
+	room.mu.Lock()
+	room.startIdleTimer()
+	room.mu.Unlock()
+
+	return room
 }
 
 // NewCustomPeerManager creates a new CustomPeerManager instance.
 func NewCustomPeerManager() *CustomPeerManager {
 	return &CustomPeerManager{
-		Connections: make([]CustomPeerConnectionState, 0),
-		TrackLocals: make(map[string]*webrtc.TrackLocalStaticRTP),
+		Connections:  make([]CustomPeerConnectionState, 0),
+		Tracks:       make(map[string]*TrackRouter),
+		Participants: make(map[string]*Participant),
+		Sessions:     make(map[string]*webrtc.PeerConnection),
+		publishers:   make(map[string]string),
 	}
 }
@@ -0,0 +1,82 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	errSubscribeForbidden = errors.New("not allowed to subscribe")
+	errTooManySources     = errors.New("too many track sources declared")
+)
+
+// Sources of video tracks, declared by the clients with track-source messages
+// before they publish the tracks. Undeclared video tracks are cameras.
+const (
+	TrackSourceCamera = "camera"
+	TrackSourceScreen = "screen"
+)
+
+// maxDeclaredSources bounds the sources a participant declares for tracks it
+// did not publish yet.
+const maxDeclaredSources = 32
+
+// DeclareSource records the source of a track the participant is about to
+// publish. Declaring the source of a published track changes nothing.
+func (p *Participant) DeclareSource(trackID, source string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.sources[trackID]; !ok && len(p.sources) >= maxDeclaredSources {
+		return errTooManySources
+	}
+	p.sources[trackID] = source
+	return nil
+}
+
+// trackSource returns the declared source of a video track, or an empty
+// string for audio tracks.
+func (p *Participant) trackSource(t *webrtc.TrackRemote) string {
+	if t.Kind() != webrtc.RTPCodecTypeVideo {
+		return ""
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if source, ok := p.sources[t.ID()]; ok {
+		return source
+	}
+	return TrackSourceCamera
+}
+
+// authorizeTrack checks that the participant may publish a track. Screen
+// shares are told apart from cameras by the source the client declared.
+func (p *Participant) authorizeTrack(t *webrtc.TrackRemote) error {
+	kind, allowed := "audio", p.Permissions.PublishAudio
+	if t.Kind() == webrtc.RTPCodecTypeVideo {
+		kind, allowed = "video", p.Permissions.PublishVideo
+		if p.trackSource(t) == TrackSourceScreen {
+			kind, allowed = "screen", p.Permissions.PublishScreen
+		}
+	}
+
+	if !allowed {
+		return newSignalingError(ErrorCodeForbidden, fmt.Errorf("not allowed to publish %s track %q", kind, t.ID()))
+	}
+	return nil
+}
+
+// publishableKinds returns the kinds of tracks the participant may publish.
+func (p *Participant) publishableKinds() []webrtc.RTPCodecType {
+	var kinds []webrtc.RTPCodecType
+	if p.Permissions.PublishVideo || p.Permissions.PublishScreen {
+		kinds = append(kinds, webrtc.RTPCodecTypeVideo)
+	}
+	if p.Permissions.PublishAudio {
+		kinds = append(kinds, webrtc.RTPCodecTypeAudio)
+	}
+	return kinds
+}
@@ -0,0 +1,219 @@
+package webrtc
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomNotFound = errors.New("room not found")
+)
+
+// closedRoomTTL is how long a closed protected room keeps its ID, access and
+// owner.
+const closedRoomTTL = 24 * time.Hour
+
+// RoomRegistry stores the rooms of a server. Besides its ID a room can be
+// reached through aliases, such as the stream hash shared with viewers.
+// Aliases and room IDs are separate namespaces, so an alias never grants
+// access to the room routes. Protected rooms keep their access and owner
+// for a while after they close, so that their ID cannot be taken over.
+type RoomRegistry interface {
+	// Create creates a room with the given options. It fails with
+	// ErrRoomExists if the ID is taken. A closed protected room is created
+	// again with its former access and owner, whatever the options.
+	Create(roomID string, options RoomOptions) (*CustomRoomManager, error)
+	// Get returns the room with the given ID.
+	Get(roomID string) (*CustomRoomManager, bool)
+	// Access returns who may enter the room with the given ID, whether it is
+	// open or a closed protected room.
+	Access(roomID string) (*RoomAccess, bool)
+	// GetAlias returns the room an alias points to.
+	GetAlias(alias string) (*CustomRoomManager, bool)
+	// List returns every room, ordered by ID.
+	List() []*CustomRoomManager
+	// Delete closes a room and removes it along with its aliases.
+	Delete(roomID string) error
+	// Alias points an alias to a room.
+	Alias(alias, roomID string) error
+}
+
+// MemoryRoomRegistry is a RoomRegistry that keeps the rooms in memory. Rooms
+// are removed once they close, only the access and owner of protected rooms
+// are kept until closedRoomTTL passes.
+type MemoryRoomRegistry struct {
+	config RoomConfig
+
+	mu        sync.RWMutex
+	rooms     map[string]*CustomRoomManager
+	aliases   map[string]string     // Room ID, keyed by alias
+	closed    map[string]closedRoom // Closed protected rooms, keyed by room ID
+	nextSweep time.Time
+}
+
+// closedRoom is what remains of a protected room after it closed.
+type closedRoom struct {
+	access  *RoomAccess
+	owner   string
+	expires time.Time
+}
+
+// NewMemoryRoomRegistry creates an empty registry whose rooms are created with
+// the given config.
+func NewMemoryRoomRegistry(config RoomConfig) *MemoryRoomRegistry {
+	return &MemoryRoomRegistry{
+		config:  config,
+		rooms:   make(map[string]*CustomRoomManager),
+		aliases: make(map[string]string),
+		closed:  make(map[string]closedRoom),
+	}
+}
+
+func (r *MemoryRoomRegistry) Create(roomID string, options RoomOptions) (*CustomRoomManager, error) {
+	access, err := newRoomAccess(options)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rooms[roomID]; ok {
+		return nil, ErrRoomExists
+	}
+
+	now := time.Now()
+	r.sweep(now)
+	closed, reopened := r.closed[roomID]
+	delete(r.closed, roomID)
+	reopened = reopened && now.Before(closed.expires)
+	if reopened {
+		access = closed.access
+	}
+
+	room := NewCustomRoomManager(roomID, r.config, access, r.forget)
+	if reopened {
+		room.Hub.SetOwner(closed.owner)
+	}
+	r.rooms[roomID] = room
+	return room, nil
+}
+
+func (r *MemoryRoomRegistry) Get(roomID string) (*CustomRoomManager, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	room, ok := r.rooms[roomID]
+	return room, ok
+}
+
+func (r *MemoryRoomRegistry) Access(roomID string) (*RoomAccess, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if room, ok := r.rooms[roomID]; ok {
+		return room.Access, true
+	}
+	closed, ok := r.closed[roomID]
+	if !ok || !time.Now().Before(closed.expires) {
+		return nil, false
+	}
+	return closed.access, true
+}
+
+func (r *MemoryRoomRegistry) GetAlias(alias string) (*CustomRoomManager, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	roomID, ok := r.aliases[alias]
+	if !ok {
+		return nil, false
+	}
+	room, ok := r.rooms[roomID]
+	return room, ok
+}
+
+func (r *MemoryRoomRegistry) List() []*CustomRoomManager {
+	r.mu.RLock()
+	rooms := make([]*CustomRoomManager, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		rooms = append(rooms, room)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].ID < rooms[j].ID
+	})
+	return rooms
+}
+
+func (r *MemoryRoomRegistry) Delete(roomID string) error {
+	r.mu.Lock()
+	room, ok := r.rooms[roomID]
+	if ok {
+		r.remove(room)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return ErrRoomNotFound
+	}
+	room.Close()
+	return nil
+}
+
+func (r *MemoryRoomRegistry) Alias(alias, roomID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rooms[roomID]; !ok {
+		return ErrRoomNotFound
+	}
+	r.aliases[alias] = roomID
+	return nil
+}
+
+// forget removes a room that closed, unless its ID already belongs to a
+// newer room.
+func (r *MemoryRoomRegistry) forget(room *CustomRoomManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rooms[room.ID] == room {
+		r.remove(room)
+	}
+}
+
+// remove deletes a room and its aliases, keeping the access and owner of
+// protected rooms. The caller must hold the lock.
+func (r *MemoryRoomRegistry) remove(room *CustomRoomManager) {
+	delete(r.rooms, room.ID)
+	if room.Access.Protected() {
+		now := time.Now()
+		r.sweep(now)
+		r.closed[room.ID] = closedRoom{access: room.Access, owner: room.Hub.Owner(), expires: now.Add(closedRoomTTL)}
+	}
+	for alias, roomID := range r.aliases {
+		if roomID == room.ID {
+			delete(r.aliases, alias)
+		}
+	}
+}
+
+// sweep forgets the closed rooms that expired, at most once per TTL. The
+// caller must hold the lock.
+func (r *MemoryRoomRegistry) sweep(now time.Time) {
+	if now.Before(r.nextSweep) {
+		return
+	}
+	r.nextSweep = now.Add(closedRoomTTL)
+
+	for roomID, closed := range r.closed {
+		if !now.Before(closed.expires) {
+			delete(r.closed, roomID)
+		}
+	}
+}
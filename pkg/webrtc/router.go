@@ -0,0 +1,253 @@
+package webrtc
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// bitrateInterval is how often the bitrate of a layer is measured.
+const bitrateInterval = time.Second
+
+// TrackRouter fans the RTP packets of a published track out to the
+// down-tracks of its subscribers. A simulcast track has one layer per RID.
+type TrackRouter struct {
+	ID          string // Unique in the room, see CustomPeerManager.routerID
+	StreamID    string
+	PublisherID string // ID of the participant publishing the track
+	Kind        webrtc.RTPCodecType
+	Source      string // Camera or screen for video tracks, see Participant.DeclareSource
+	Codec       webrtc.RTPCodecCapability
+
+	publishedID string // ID the publisher gave the track
+
+	mu         sync.RWMutex
+	layers     map[string]*routerLayer
+	downTracks map[string]*DownTrack // Keyed by subscriber ID
+}
+
+// routerLayer is one encoding of a published track.
+type routerLayer struct {
+	rid      string
+	track    *webrtc.TrackRemote
+	receiver *webrtc.RTPReceiver
+	bitrate  atomic.Uint64 // Measured bits per second
+
+	keyframeLock        sync.Mutex
+	lastKeyframeRequest time.Time
+}
+
+func newTrackRouter(id string, t *webrtc.TrackRemote, publisherID string) *TrackRouter {
+	return &TrackRouter{
+		ID:          id,
+		StreamID:    t.StreamID(),
+		PublisherID: publisherID,
+		Kind:        t.Kind(),
+		Codec:       t.Codec().RTPCodecCapability,
+		publishedID: t.ID(),
+		layers:      make(map[string]*routerLayer),
+		downTracks:  make(map[string]*DownTrack),
+	}
+}
+
+// addLayer registers an encoding of the track and lets every subscriber
+// reconsider which layer it receives.
+func (r *TrackRouter) addLayer(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	r.mu.Lock()
+	r.layers[t.RID()] = &routerLayer{rid: t.RID(), track: t, receiver: receiver}
+	r.mu.Unlock()
+
+	r.updateDownTracks()
+}
+
+// removeLayer unregisters an encoding and reports whether the track has no
+// layers left.
+func (r *TrackRouter) removeLayer(rid string) bool {
+	r.mu.Lock()
+	delete(r.layers, rid)
+	empty := len(r.layers) == 0
+	r.mu.Unlock()
+
+	if !empty {
+		r.updateDownTracks()
+	}
+	return empty
+}
+
+func (r *TrackRouter) updateDownTracks() {
+	for _, downTrack := range r.subscribers() {
+		downTrack.updateTarget()
+	}
+}
+
+func (r *TrackRouter) subscribers() []*DownTrack {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	downTracks := make([]*DownTrack, 0, len(r.downTracks))
+	for _, downTrack := range r.downTracks {
+		downTracks = append(downTracks, downTrack)
+	}
+	return downTracks
+}
+
+// Subscribe creates the down-track that forwards the track to a subscriber.
+func (r *TrackRouter) Subscribe(subscriberID string) (*DownTrack, error) {
+	downTrack, err := newDownTrack(r, subscriberID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.downTracks[subscriberID] = downTrack
+	r.mu.Unlock()
+
+	downTrack.updateTarget()
+	return downTrack, nil
+}
+
+// Unsubscribe stops forwarding the track to a subscriber.
+func (r *TrackRouter) Unsubscribe(subscriberID string) {
+	r.mu.Lock()
+	downTrack, ok := r.downTracks[subscriberID]
+	delete(r.downTracks, subscriberID)
+	r.mu.Unlock()
+
+	if ok {
+		downTrack.close()
+	}
+}
+
+// close stops every down-track of the router.
+func (r *TrackRouter) close() {
+	r.mu.Lock()
+	downTracks := r.downTracks
+	r.downTracks = make(map[string]*DownTrack)
+	r.mu.Unlock()
+
+	for _, downTrack := range downTracks {
+		downTrack.close()
+	}
+}
+
+// DownTrack returns the down-track of a subscriber.
+func (r *TrackRouter) DownTrack(subscriberID string) (*DownTrack, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	downTrack, ok := r.downTracks[subscriberID]
+	return downTrack, ok
+}
+
+// forwardRTP reads the packets of one layer until the publisher stops
+// sending it and hands them to every down-track.
+func (r *TrackRouter) forwardRTP(t *webrtc.TrackRemote) {
+	r.mu.RLock()
+	layer, ok := r.layers[t.RID()]
+	r.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	var received uint64
+	measureStart := time.Now()
+	for {
+		packet, _, err := t.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		received += uint64(packet.MarshalSize())
+		if elapsed := time.Since(measureStart); elapsed >= bitrateInterval {
+			layer.bitrate.Store(received * 8 * uint64(time.Second) / uint64(elapsed))
+			received = 0
+			measureStart = time.Now()
+		}
+
+		r.mu.RLock()
+		for _, downTrack := range r.downTracks {
+			downTrack.writeRTP(layer.rid, packet)
+		}
+		r.mu.RUnlock()
+	}
+}
+
+// selectLayer returns the RID of the best layer that does not exceed the
+// preferred quality and fits the bandwidth (0 if unknown). The lowest layer
+// is used when nothing fits.
+func (r *TrackRouter) selectLayer(preferred Layer, bandwidth uint64) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	layers := make([]*routerLayer, 0, len(r.layers))
+	for _, layer := range r.layers {
+		layers = append(layers, layer)
+	}
+	if len(layers) == 0 {
+		return ""
+	}
+
+	sort.Slice(layers, func(i, j int) bool {
+		return layerForRID(layers[i].rid) < layerForRID(layers[j].rid)
+	})
+
+	selected := layers[0].rid
+	for _, layer := range layers[1:] {
+		if layerForRID(layer.rid) > preferred {
+			break
+		}
+		if bandwidth > 0 && layer.bitrate.Load() > bandwidth {
+			break
+		}
+		selected = layer.rid
+	}
+	return selected
+}
+
+// RequestKeyframe asks the publisher for a keyframe on every layer.
+func (r *TrackRouter) RequestKeyframe() {
+	r.mu.RLock()
+	rids := make([]string, 0, len(r.layers))
+	for rid := range r.layers {
+		rids = append(rids, rid)
+	}
+	r.mu.RUnlock()
+
+	for _, rid := range rids {
+		r.requestLayerKeyframe(rid)
+	}
+}
+
+// requestLayerKeyframe sends an RTCP PictureLossIndication for one layer to
+// the publisher. Requests are throttled by keyframeRequestInterval.
+func (r *TrackRouter) requestLayerKeyframe(rid string) {
+	if r.Kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	r.mu.RLock()
+	layer, ok := r.layers[rid]
+	r.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	layer.keyframeLock.Lock()
+	if time.Since(layer.lastKeyframeRequest) < keyframeRequestInterval {
+		layer.keyframeLock.Unlock()
+		return
+	}
+	layer.lastKeyframeRequest = time.Now()
+	layer.keyframeLock.Unlock()
+
+	if _, err := layer.receiver.Transport().WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.track.SSRC())},
+	}); err != nil {
+		log.Printf("Error requesting keyframe: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package webrtc
+
+import "testing"
+
+func TestSelectLayer(t *testing.T) {
+	// Bitrates of the layers, keyed by RID
+	simulcast := map[string]uint64{"q": 150_000, "h": 500_000, "f": 1_500_000}
+
+	tests := []struct {
+		name      string
+		layers    map[string]uint64
+		preferred Layer
+		bandwidth uint64
+		want      string
+	}{
+		{
+			name:      "highest layer",
+			layers:    simulcast,
+			preferred: LayerHigh,
+			want:      "f",
+		},
+		{
+			name:      "preferred layer",
+			layers:    simulcast,
+			preferred: LayerMid,
+			want:      "h",
+		},
+		{
+			name:      "lowest preferred layer",
+			layers:    simulcast,
+			preferred: LayerLow,
+			want:      "q",
+		},
+		{
+			name:      "layer fitting the bandwidth",
+			layers:    simulcast,
+			preferred: LayerHigh,
+			bandwidth: 1_000_000,
+			want:      "h",
+		},
+		{
+			name:      "lowest layer when nothing fits",
+			layers:    simulcast,
+			preferred: LayerHigh,
+			bandwidth: 100_000,
+			want:      "q",
+		},
+		{
+			name:      "layer without measured bitrate",
+			layers:    map[string]uint64{"q": 150_000, "f": 0},
+			preferred: LayerHigh,
+			bandwidth: 200_000,
+			want:      "f",
+		},
+		{
+			name:      "unknown RIDs are middle layers",
+			layers:    map[string]uint64{"q": 0, "x": 0},
+			preferred: LayerMid,
+			want:      "x",
+		},
+		{
+			name:      "no layers",
+			preferred: LayerHigh,
+			want:      "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := &TrackRouter{layers: make(map[string]*routerLayer)}
+			for rid, bitrate := range test.layers {
+				layer := &routerLayer{rid: rid}
+				layer.bitrate.Store(bitrate)
+				router.layers[rid] = layer
+			}
+
+			if got := router.selectLayer(test.preferred, test.bandwidth); got != test.want {
+				t.Errorf("selectLayer(%s, %d) = %q, want %q", test.preferred, test.bandwidth, got, test.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package webrtc
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"sync"
@@ -10,35 +10,47 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-func CustomRoomConnection(c *websocket.Conn, p *CustomPeerManager) {
+func CustomRoomConnection(c *websocket.Conn, participant *Participant, p *CustomPeerManager) {
+	if err := p.join(); err != nil {
+		log.Println(err)
+		return
+	}
+	defer p.leave()
+
 	var config webrtc.Configuration
 	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
 		config = turnConfig
 	}
 
-	peerConnection := createPeerConnection(config, c, p)
+	peerConnection := createPeerConnection(config, participant)
 	if peerConnection == nil {
 		return
 	}
 	defer peerConnection.Close()
 
-	newPeer := addPeerConnectionToList(peerConnection, c, p)
+	newPeer, err := addPeerConnectionToList(peerConnection, c, participant, p)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	defer removePeerConnectionFromList(newPeer, p)
 
 	setupPeerConnectionCallbacks(peerConnection, newPeer, p) // Fix the argument count here
 	p.SignalPeerConnectionHelper()
 
-	handleIncomingData(c, peerConnection, p)
+	handleIncomingData(c, newPeer, p)
 }
 
-func createPeerConnection(config webrtc.Configuration, c *websocket.Conn, p *CustomPeerManager) *webrtc.PeerConnection {
-	peerConnection, err := webrtc.NewPeerConnection(config)
+// createPeerConnection creates the peer connection of a room peer, ready to
+// receive the kinds of tracks the participant may publish.
+func createPeerConnection(config webrtc.Configuration, participant *Participant) *webrtc.PeerConnection {
+	peerConnection, err := newCustomPeerConnection(config)
 	if err != nil {
 		log.Print(err)
 		return nil
 	}
 
-	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+	for _, typ := range participant.publishableKinds() {
 		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
 		}); err != nil {
@@ -50,22 +62,29 @@ func createPeerConnection(config webrtc.Configuration, c *websocket.Conn, p *Cus
 	return peerConnection
 }
 
-func addPeerConnectionToList(peerConnection *webrtc.PeerConnection, c *websocket.Conn, p *CustomPeerManager) CustomPeerConnectionState {
+func addPeerConnectionToList(peerConnection *webrtc.PeerConnection, c *websocket.Conn, participant *Participant, p *CustomPeerManager) (CustomPeerConnectionState, error) {
 	newPeer := CustomPeerConnectionState{
+		Participant:    participant,
 		PeerConnection: peerConnection,
 		Websocket: &CustomThreadSafeWriter{
-			Conn:  c,
-			Mutex: sync.Mutex{},
+			Conn:    c,
+			Mutex:   sync.Mutex{},
+			Version: negotiateSignalingVersion(c),
 		},
+		Subscription: NewSubscription(),
+		offerPending: true,
 	}
 
 	p.ListLock.Lock()
-	p.Connections = append(p.Connections, newPeer)
-	p.ListLock.Unlock()
-
-	log.Println(p.Connections)
+	defer p.ListLock.Unlock()
 
-	return newPeer
+	if err := p.addParticipant(participant); err != nil {
+		newPeer.Websocket.writeSignalError("", newSignalingError(ErrorCodeParticipantExists, err))
+		return newPeer, err
+	}
+	p.Connections = append(p.Connections, newPeer)
+	p.sendParticipants(newPeer)
+	return newPeer, nil
 }
 
 func removePeerConnectionFromList(newPeer CustomPeerConnectionState, p *CustomPeerManager) {
@@ -73,6 +92,8 @@ func removePeerConnectionFromList(newPeer CustomPeerConnectionState, p *CustomPe
 	defer p.ListLock.Unlock()
 
 	p.Connections = removeCustomConnection(p.Connections, &newPeer)
+	p.unsubscribeAll(newPeer.Participant.ID)
+	p.removeParticipant(newPeer.Participant.ID)
 }
 
 func setupPeerConnectionCallbacks(peerConnection *webrtc.PeerConnection, newPeer CustomPeerConnectionState, p *CustomPeerManager) {
@@ -81,16 +102,7 @@ func setupPeerConnectionCallbacks(peerConnection *webrtc.PeerConnection, newPeer
 			return
 		}
 
-		candidateString, err := json.Marshal(i.ToJSON())
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		if writeErr := newPeer.Websocket.WriteJSON(&CustomWebSocketMessage{
-			Event: "custom-candidate",
-			Data:  string(candidateString),
-		}); writeErr != nil {
+		if writeErr := newPeer.Websocket.WriteSignal(SignalCandidate, "", i.ToJSON()); writeErr != nil {
 			log.Println(writeErr)
 		}
 	})
@@ -100,7 +112,9 @@ func setupPeerConnectionCallbacks(peerConnection *webrtc.PeerConnection, newPeer
 	})
 
 	peerConnection.OnTrack(func(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		handleIncomingTrack(t, newPeer, p)
+		if err := handleIncomingTrack(t, receiver, newPeer.Participant, p); err != nil {
+			newPeer.Websocket.writeSignalError("", err)
+		}
 	})
 }
 
@@ -115,69 +129,63 @@ func handleConnectionStateChange(pp webrtc.PeerConnectionState, peerConnection *
 	}
 }
 
-func handleIncomingData(c *websocket.Conn, peerConnection *webrtc.PeerConnection, p *CustomPeerManager) {
-	for {
-		_, raw, err := c.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		message := &CustomWebSocketMessage{}
-		if err := json.Unmarshal(raw, &message); err != nil {
-			log.Println(err)
-			return
-		}
-
-		switch message.Event {
-		case "custom-candidate":
-			handleICECandidate(message.Data, peerConnection)
-		case "custom-answer":
-			handleSessionAnswer(message.Data, peerConnection)
-		}
+func handleICECandidate(candidate webrtc.ICECandidateInit, peerConnection *webrtc.PeerConnection) error {
+	if err := peerConnection.AddICECandidate(candidate); err != nil {
+		return newSignalingError(ErrorCodeNegotiation, err)
 	}
+	return nil
 }
 
-func handleICECandidate(candidateData string, peerConnection *webrtc.PeerConnection) {
-	candidate := webrtc.ICECandidateInit{}
-	if err := json.Unmarshal([]byte(candidateData), &candidate); err != nil {
-		log.Println(err)
-		return
+func handleSessionAnswer(answer webrtc.SessionDescription, peerConnection *webrtc.PeerConnection) error {
+	if peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return newSignalingError(ErrorCodeNegotiation, errors.New("no pending offer to answer"))
 	}
 
-	if err := peerConnection.AddICECandidate(candidate); err != nil {
-		log.Println(err)
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		return newSignalingError(ErrorCodeNegotiation, err)
 	}
+	return nil
 }
 
-func handleSessionAnswer(answerData string, peerConnection *webrtc.PeerConnection) {
-	answer := webrtc.SessionDescription{}
-	if err := json.Unmarshal([]byte(answerData), &answer); err != nil {
-		log.Println(err)
-		return
+// handleSessionOffer answers an offer initiated by the peer. The server acts
+// as the impolite side of the negotiation: if an offer of its own is still
+// pending, the peer's offer is rejected and the peer is expected to roll back
+// and answer the server's offer instead.
+func handleSessionOffer(id string, offer webrtc.SessionDescription, peer CustomPeerConnectionState) error {
+	peerConnection := peer.PeerConnection
+	if peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		return newSignalingError(ErrorCodeOfferCollision, errors.New("an offer from the server is pending"))
 	}
 
-	if err := peerConnection.SetRemoteDescription(answer); err != nil {
-		log.Println(err)
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return newSignalingError(ErrorCodeNegotiation, err)
 	}
-}
 
-func handleIncomingTrack(t *webrtc.TrackRemote, newPeer CustomPeerConnectionState, p *CustomPeerManager) {
-	customTrackLocal := p.AddCustomTrack(t)
-	if customTrackLocal == nil {
-		return
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return newSignalingError(ErrorCodeNegotiation, err)
 	}
-	defer p.RemoveCustomTrack(customTrackLocal)
 
-	buf := make([]byte, 1500)
-	for {
-		i, _, err := t.Read(buf)
-		if err != nil {
-			return
-		}
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return newSignalingError(ErrorCodeNegotiation, err)
+	}
 
-		if _, err = customTrackLocal.Write(buf[:i]); err != nil {
-			return
+	return peer.Websocket.WriteSignal(SignalAnswer, id, answer)
+}
+
+// handleIncomingTrack forwards a track published by a participant until it
+// ends. Tracks the participant may not publish are stopped and rejected.
+func handleIncomingTrack(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, publisher *Participant, p *CustomPeerManager) error {
+	if err := publisher.authorizeTrack(t); err != nil {
+		if stopErr := receiver.Stop(); stopErr != nil {
+			log.Printf("Error stopping rejected track: %v", stopErr)
 		}
+		return err
 	}
+
+	router := p.AddCustomTrack(t, receiver, publisher)
+	defer p.RemoveCustomTrack(router, t.RID())
+
+	router.forwardRTP(t)
+	return nil
 }
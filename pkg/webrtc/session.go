@@ -0,0 +1,176 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	gguid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrSessionNotFound      = errors.New("session not found")
+	errPeerConnectionCreate = errors.New("failed to create peer connection")
+)
+
+func newSessionID() string {
+	return gguid.New().String()
+}
+
+// startCustomSession answers an HTTP negotiated (WHIP/WHEP) offer and registers
+// the peer connection as a session of the manager. ICE gathering is completed
+// before returning, so the answer already carries the server candidates.
+// It returns the session ID and the SDP answer.
+func (p *CustomPeerManager) startCustomSession(sessionID string, peerConnection *webrtc.PeerConnection, offerSDP string) (string, string, error) {
+	if err := p.join(); err != nil {
+		peerConnection.Close()
+		return "", "", err
+	}
+
+	peerConnection.OnConnectionStateChange(func(pp webrtc.PeerConnectionState) {
+		switch pp {
+		case webrtc.PeerConnectionStateFailed:
+			if err := peerConnection.Close(); err != nil {
+				log.Print(err)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			p.removeCustomSession(sessionID)
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerSDP,
+	}); err != nil {
+		peerConnection.Close()
+		p.leave()
+		return "", "", err
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		p.leave()
+		return "", "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		p.leave()
+		return "", "", err
+	}
+	<-gatherComplete
+
+	p.SessionsLock.Lock()
+	p.Sessions[sessionID] = peerConnection
+	p.SessionsLock.Unlock()
+
+	return sessionID, peerConnection.LocalDescription().SDP, nil
+}
+
+// PatchCustomSession applies a trickle ICE SDP fragment to a session.
+func (p *CustomPeerManager) PatchCustomSession(sessionID, fragment string) error {
+	peerConnection, ok := p.getCustomSession(sessionID)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	for _, candidate := range parseTrickleICEFragment(fragment) {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseCustomSession tears down a session and its peer connection.
+func (p *CustomPeerManager) CloseCustomSession(sessionID string) error {
+	peerConnection, ok := p.getCustomSession(sessionID)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	p.removeCustomSession(sessionID)
+	return peerConnection.Close()
+}
+
+func (p *CustomPeerManager) getCustomSession(sessionID string) (*webrtc.PeerConnection, bool) {
+	p.SessionsLock.RLock()
+	defer p.SessionsLock.RUnlock()
+
+	peerConnection, ok := p.Sessions[sessionID]
+	return peerConnection, ok
+}
+
+func (p *CustomPeerManager) removeCustomSession(sessionID string) {
+	p.SessionsLock.Lock()
+	_, ok := p.Sessions[sessionID]
+	participantID, published := p.publishers[sessionID]
+	delete(p.Sessions, sessionID)
+	delete(p.publishers, sessionID)
+	p.SessionsLock.Unlock()
+
+	if ok {
+		defer p.leave()
+	}
+	if p.room != nil {
+		// Sessions are admitted to protected rooms by their ID
+		p.room.Access.Revoke(sessionID)
+	}
+
+	p.ListLock.Lock()
+	p.unsubscribeAll(sessionID)
+	if published {
+		p.removeParticipant(participantID)
+	}
+	p.ListLock.Unlock()
+
+	if published {
+		p.SignalPeerConnectionHelper()
+	}
+}
+
+// unsubscribeSession stops forwarding tracks to a session.
+func (p *CustomPeerManager) unsubscribeSession(sessionID string) {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	p.unsubscribeAll(sessionID)
+}
+
+// parseTrickleICEFragment extracts the ICE candidates of an
+// application/trickle-ice-sdpfrag body (RFC 8840), keeping track of the
+// media section each candidate belongs to.
+func parseTrickleICEFragment(fragment string) []webrtc.ICECandidateInit {
+	var (
+		candidates []webrtc.ICECandidateInit
+		mid        *string
+		mLineIndex *uint16
+		mLines     uint16
+	)
+
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index := mLines
+			mLineIndex = &index
+			mid = nil
+			mLines++
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: mLineIndex,
+			})
+		}
+	}
+
+	return candidates
+}
@@ -0,0 +1,84 @@
+package webrtc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseTrickleICEFragment(t *testing.T) {
+	mid := func(value string) *string { return &value }
+	index := func(value uint16) *uint16 { return &value }
+
+	tests := []struct {
+		name     string
+		fragment string
+		want     []webrtc.ICECandidateInit
+	}{
+		{
+			name:     "empty",
+			fragment: "",
+		},
+		{
+			name: "one media section",
+			fragment: "a=ice-ufrag:EsAw\r\n" +
+				"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+				"m=audio 9 RTP/AVP 0\r\n" +
+				"a=mid:0\r\n" +
+				"a=candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host\r\n" +
+				"a=end-of-candidates\r\n",
+			want: []webrtc.ICECandidateInit{
+				{Candidate: "candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host", SDPMid: mid("0"), SDPMLineIndex: index(0)},
+			},
+		},
+		{
+			name: "several media sections",
+			fragment: "m=audio 9 RTP/AVP 0\r\n" +
+				"a=mid:audio\r\n" +
+				"a=candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host\r\n" +
+				"m=video 9 RTP/AVP 0\r\n" +
+				"a=mid:video\r\n" +
+				"a=candidate:2 1 UDP 2130706431 198.51.100.1 39133 typ host\r\n" +
+				"a=candidate:3 1 UDP 1694498815 203.0.113.7 39133 typ srflx raddr 198.51.100.1 rport 39133\r\n",
+			want: []webrtc.ICECandidateInit{
+				{Candidate: "candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host", SDPMid: mid("audio"), SDPMLineIndex: index(0)},
+				{Candidate: "candidate:2 1 UDP 2130706431 198.51.100.1 39133 typ host", SDPMid: mid("video"), SDPMLineIndex: index(1)},
+				{Candidate: "candidate:3 1 UDP 1694498815 203.0.113.7 39133 typ srflx raddr 198.51.100.1 rport 39133", SDPMid: mid("video"), SDPMLineIndex: index(1)},
+			},
+		},
+		{
+			name: "media section without mid",
+			fragment: "m=audio 9 RTP/AVP 0\n" +
+				"a=candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host\n",
+			want: []webrtc.ICECandidateInit{
+				{Candidate: "candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host", SDPMLineIndex: index(0)},
+			},
+		},
+		{
+			name:     "candidate without media section",
+			fragment: "a=candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host\r\n",
+			want: []webrtc.ICECandidateInit{
+				{Candidate: "candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host"},
+			},
+		},
+		{
+			name: "mid of the previous section not inherited",
+			fragment: "m=audio 9 RTP/AVP 0\r\n" +
+				"a=mid:0\r\n" +
+				"m=video 9 RTP/AVP 0\r\n" +
+				"a=candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host\r\n",
+			want: []webrtc.ICECandidateInit{
+				{Candidate: "candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host", SDPMLineIndex: index(1)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseTrickleICEFragment(test.fragment); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseTrickleICEFragment() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
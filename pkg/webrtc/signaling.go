@@ -0,0 +1,387 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// SignalType identifies the payload carried by a SignalMessage.
+type SignalType string
+
+const (
+	SignalOffer             SignalType = "offer"              // webrtc.SessionDescription
+	SignalAnswer            SignalType = "answer"             // webrtc.SessionDescription
+	SignalCandidate         SignalType = "candidate"          // webrtc.ICECandidateInit
+	SignalError             SignalType = "error"              // ErrorPayload
+	SignalKeyframe          SignalType = "keyframe"           // KeyframePayload
+	SignalTrackAdded        SignalType = "track-added"        // TrackPayload
+	SignalTrackRemoved      SignalType = "track-removed"      // TrackPayload
+	SignalParticipantJoined SignalType = "participant-joined" // ParticipantPayload
+	SignalParticipantLeft   SignalType = "participant-left"   // ParticipantPayload
+	SignalLayer             SignalType = "layer"              // LayerPayload
+	SignalPause             SignalType = "pause"              // TrackControlPayload
+	SignalResume            SignalType = "resume"             // TrackControlPayload
+	SignalSubscribe         SignalType = "subscribe"          // SubscriptionPayload
+	SignalUnsubscribe       SignalType = "unsubscribe"        // SubscriptionPayload
+	SignalRoomClosed        SignalType = "room-closed"        // RoomClosedPayload
+	SignalTrackSource       SignalType = "track-source"       // TrackSourcePayload
+)
+
+const (
+	// SignalingVersionLegacy is the untyped {event, data} protocol spoken by
+	// clients that do not request a signaling subprotocol.
+	SignalingVersionLegacy = 1
+	// SignalingVersion is the current typed protocol.
+	SignalingVersion = 2
+
+	legacyEventPrefix = "custom-"
+)
+
+// SignalingSubprotocols lists the websocket subprotocols accepted on the
+// signaling routes, newest first. The subprotocol picked during the websocket
+// handshake decides the protocol version of the connection.
+var SignalingSubprotocols = []string{"golivesync.v2"}
+
+var signalingVersions = map[string]int{
+	"golivesync.v2": SignalingVersion,
+}
+
+// Error codes sent in ErrorPayload.Code.
+const (
+	ErrorCodeBadMessage         = "bad-message"
+	ErrorCodeUnsupportedVersion = "unsupported-version"
+	ErrorCodeUnknownType        = "unknown-type"
+	ErrorCodeBadPayload         = "bad-payload"
+	ErrorCodeNegotiation        = "negotiation-failed"
+	ErrorCodeOfferCollision     = "offer-collision"
+	ErrorCodeUnknownTrack       = "unknown-track"
+	ErrorCodeForbidden          = "forbidden"
+	ErrorCodeParticipantExists  = "participant-exists"
+)
+
+// SignalMessage is the envelope of every message of the typed signaling
+// protocol. Replies carry the ID of the message they answer.
+type SignalMessage struct {
+	Version int             `json:"version"`
+	ID      string          `json:"id,omitempty"`
+	Type    SignalType      `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ErrorPayload reports why a message could not be processed.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// KeyframePayload asks the server to request a new keyframe from the
+// publisher of a track.
+type KeyframePayload struct {
+	TrackID string `json:"trackId,omitempty"`
+}
+
+// TrackPayload describes a track that was added to or removed from the room.
+type TrackPayload struct {
+	TrackID       string `json:"trackId"`
+	StreamID      string `json:"streamId"`
+	ParticipantID string `json:"participantId"` // Publisher of the track
+	Kind          string `json:"kind"`
+	Source        string `json:"source,omitempty"` // Camera or screen for video tracks
+}
+
+// TrackSourcePayload declares the source, camera or screen, of a video track
+// the peer is about to publish.
+type TrackSourcePayload struct {
+	TrackID string `json:"trackId"`
+	Source  string `json:"source"`
+}
+
+// ParticipantPayload describes a participant that joined or left the room
+// and the tracks it publishes.
+type ParticipantPayload struct {
+	ParticipantID string            `json:"participantId"`
+	DisplayName   string            `json:"displayName,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Tracks        []TrackPayload    `json:"tracks"`
+}
+
+// LayerPayload selects the highest simulcast layer (high, mid or low) the
+// subscriber wants to receive for a track.
+type LayerPayload struct {
+	TrackID string `json:"trackId"`
+	Layer   string `json:"layer"`
+}
+
+// TrackControlPayload names the track a subscriber pauses or resumes.
+type TrackControlPayload struct {
+	TrackID string `json:"trackId"`
+}
+
+// SubscriptionPayload changes the tracks a peer receives, either every track
+// (All) or the given tracks and the tracks of the given participants.
+type SubscriptionPayload struct {
+	All            bool     `json:"all,omitempty"`
+	TrackIDs       []string `json:"trackIds,omitempty"`
+	ParticipantIDs []string `json:"participantIds,omitempty"`
+}
+
+// RoomClosedPayload tells the peers why the room closed before they are
+// disconnected.
+type RoomClosedPayload struct {
+	Reason string `json:"reason"`
+}
+
+// signalingError is a failure that is reported back to the client with an
+// explicit error code.
+type signalingError struct {
+	code string
+	err  error
+}
+
+func (e *signalingError) Error() string {
+	return fmt.Sprintf("%s: %v", e.code, e.err)
+}
+
+func (e *signalingError) Unwrap() error {
+	return e.err
+}
+
+func newSignalingError(code string, err error) error {
+	return &signalingError{code: code, err: err}
+}
+
+// negotiateSignalingVersion returns the protocol version selected by the
+// websocket subprotocol, falling back to the legacy protocol.
+func negotiateSignalingVersion(c *websocket.Conn) int {
+	if version, ok := signalingVersions[c.Subprotocol()]; ok {
+		return version
+	}
+	return SignalingVersionLegacy
+}
+
+// WriteSignal sends a message of the given type to the peer, encoded for the
+// protocol version of the connection. Legacy clients only understand offers,
+// answers and candidates, other messages are not sent to them.
+func (t *CustomThreadSafeWriter) WriteSignal(typ SignalType, id string, payload interface{}) error {
+	if t.Version == SignalingVersionLegacy {
+		return t.writeLegacySignal(typ, payload)
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	if id == "" {
+		t.sequence++
+		id = fmt.Sprintf("s%d", t.sequence)
+	}
+
+	return t.Conn.WriteJSON(&SignalMessage{
+		Version: t.Version,
+		ID:      id,
+		Type:    typ,
+		Payload: raw,
+	})
+}
+
+func (t *CustomThreadSafeWriter) writeLegacySignal(typ SignalType, payload interface{}) error {
+	switch typ {
+	case SignalOffer, SignalAnswer, SignalCandidate:
+	default:
+		return nil
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return t.WriteJSON(&CustomWebSocketMessage{
+		Event: legacyEventPrefix + string(typ),
+		Data:  string(raw),
+	})
+}
+
+// writeSignalError reports a failed message back to the peer.
+func (t *CustomThreadSafeWriter) writeSignalError(id string, err error) {
+	payload := ErrorPayload{Code: ErrorCodeBadMessage, Message: err.Error()}
+
+	var signalErr *signalingError
+	if errors.As(err, &signalErr) {
+		payload = ErrorPayload{Code: signalErr.code, Message: signalErr.err.Error()}
+	}
+
+	if writeErr := t.WriteSignal(SignalError, id, payload); writeErr != nil {
+		log.Println(writeErr)
+	}
+}
+
+// decodeSignalMessage parses a raw websocket message of the given protocol
+// version. Legacy messages are converted to the typed envelope, their data
+// string already holds the JSON encoded payload.
+func decodeSignalMessage(raw []byte, version int) (*SignalMessage, error) {
+	if version == SignalingVersionLegacy {
+		legacy := CustomWebSocketMessage{}
+		if err := json.Unmarshal(raw, &legacy); err != nil {
+			return nil, newSignalingError(ErrorCodeBadMessage, err)
+		}
+
+		return &SignalMessage{
+			Version: SignalingVersionLegacy,
+			Type:    SignalType(strings.TrimPrefix(legacy.Event, legacyEventPrefix)),
+			Payload: json.RawMessage(legacy.Data),
+		}, nil
+	}
+
+	message := &SignalMessage{}
+	if err := json.Unmarshal(raw, message); err != nil {
+		return nil, newSignalingError(ErrorCodeBadMessage, err)
+	}
+
+	if message.Version != version {
+		return message, newSignalingError(ErrorCodeUnsupportedVersion, fmt.Errorf("expected version %d, got %d", version, message.Version))
+	}
+	return message, nil
+}
+
+// handleIncomingData reads signaling messages from the websocket until it is
+// closed. Malformed or failed messages are answered with an error message
+// instead of dropping the connection.
+func handleIncomingData(c *websocket.Conn, peer CustomPeerConnectionState, p *CustomPeerManager) {
+	for {
+		_, raw, err := c.ReadMessage()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		message, err := decodeSignalMessage(raw, peer.Websocket.Version)
+		if err == nil {
+			err = handleSignalMessage(message, peer, p)
+		}
+
+		if err != nil {
+			log.Println(err)
+
+			id := ""
+			if message != nil {
+				id = message.ID
+			}
+			peer.Websocket.writeSignalError(id, err)
+		}
+	}
+}
+
+func handleSignalMessage(message *SignalMessage, peer CustomPeerConnectionState, p *CustomPeerManager) error {
+	switch message.Type {
+	case SignalCandidate:
+		candidate := webrtc.ICECandidateInit{}
+		if err := json.Unmarshal(message.Payload, &candidate); err != nil {
+			return newSignalingError(ErrorCodeBadPayload, err)
+		}
+		return handleICECandidate(candidate, peer.PeerConnection)
+	case SignalAnswer:
+		answer := webrtc.SessionDescription{}
+		if err := json.Unmarshal(message.Payload, &answer); err != nil {
+			return newSignalingError(ErrorCodeBadPayload, err)
+		}
+		return handleSessionAnswer(answer, peer.PeerConnection)
+	case SignalOffer:
+		offer := webrtc.SessionDescription{}
+		if err := json.Unmarshal(message.Payload, &offer); err != nil {
+			return newSignalingError(ErrorCodeBadPayload, err)
+		}
+		return handleSessionOffer(message.ID, offer, peer)
+	case SignalKeyframe:
+		keyframe := KeyframePayload{}
+		if err := json.Unmarshal(message.Payload, &keyframe); err != nil {
+			return newSignalingError(ErrorCodeBadPayload, err)
+		}
+		p.RequestKeyframe(keyframe.TrackID)
+		return nil
+	case SignalLayer:
+		return handleLayerRequest(message.Payload, peer, p)
+	case SignalPause, SignalResume:
+		return handleTrackControl(message.Type == SignalPause, message.Payload, peer, p)
+	case SignalSubscribe, SignalUnsubscribe:
+		return handleSubscription(message.Type == SignalSubscribe, message.Payload, peer, p)
+	case SignalTrackSource:
+		return handleTrackSource(message.Payload, peer)
+	default:
+		return newSignalingError(ErrorCodeUnknownType, fmt.Errorf("unknown message type %q", message.Type))
+	}
+}
+
+func handleLayerRequest(payload json.RawMessage, peer CustomPeerConnectionState, p *CustomPeerManager) error {
+	request := LayerPayload{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return newSignalingError(ErrorCodeBadPayload, err)
+	}
+
+	layer, ok := ParseLayer(request.Layer)
+	if !ok {
+		return newSignalingError(ErrorCodeBadPayload, fmt.Errorf("unknown layer %q", request.Layer))
+	}
+
+	if err := p.SetPreferredLayer(peer.Participant.ID, request.TrackID, layer); err != nil {
+		return newSignalingError(ErrorCodeUnknownTrack, err)
+	}
+	return nil
+}
+
+func handleTrackControl(paused bool, payload json.RawMessage, peer CustomPeerConnectionState, p *CustomPeerManager) error {
+	request := TrackControlPayload{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return newSignalingError(ErrorCodeBadPayload, err)
+	}
+
+	if err := p.SetTrackPaused(peer.Participant.ID, request.TrackID, paused); err != nil {
+		return newSignalingError(ErrorCodeUnknownTrack, err)
+	}
+	return nil
+}
+
+func handleSubscription(subscribe bool, payload json.RawMessage, peer CustomPeerConnectionState, p *CustomPeerManager) error {
+	request := SubscriptionPayload{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return newSignalingError(ErrorCodeBadPayload, err)
+	}
+
+	if subscribe && !peer.Participant.Permissions.Subscribe {
+		return newSignalingError(ErrorCodeForbidden, errSubscribeForbidden)
+	}
+
+	if subscribe {
+		peer.Subscription.Subscribe(request.All, request.TrackIDs, request.ParticipantIDs)
+	} else {
+		peer.Subscription.Unsubscribe(request.All, request.TrackIDs, request.ParticipantIDs)
+	}
+
+	p.SignalPeerConnectionHelper()
+	return nil
+}
+
+func handleTrackSource(payload json.RawMessage, peer CustomPeerConnectionState) error {
+	request := TrackSourcePayload{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return newSignalingError(ErrorCodeBadPayload, err)
+	}
+	if request.TrackID == "" || (request.Source != TrackSourceCamera && request.Source != TrackSourceScreen) {
+		return newSignalingError(ErrorCodeBadPayload, fmt.Errorf("unknown source %q of track %q", request.Source, request.TrackID))
+	}
+
+	if err := peer.Participant.DeclareSource(request.TrackID, request.Source); err != nil {
+		return newSignalingError(ErrorCodeBadPayload, err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Layer is the quality of a simulcast encoding.
+type Layer int
+
+const (
+	LayerLow Layer = iota
+	LayerMid
+	LayerHigh
+)
+
+var layerNames = map[string]Layer{
+	"low":  LayerLow,
+	"mid":  LayerMid,
+	"high": LayerHigh,
+}
+
+// ridLayers maps the RIDs commonly used by browsers and encoders to a layer.
+// Unknown RIDs are treated as the middle layer.
+var ridLayers = map[string]Layer{
+	"":       LayerHigh,
+	"f":      LayerHigh,
+	"hi":     LayerHigh,
+	"high":   LayerHigh,
+	"h":      LayerMid,
+	"m":      LayerMid,
+	"mid":    LayerMid,
+	"medium": LayerMid,
+	"q":      LayerLow,
+	"l":      LayerLow,
+	"lo":     LayerLow,
+	"low":    LayerLow,
+}
+
+// ParseLayer parses a layer name (high, mid or low).
+func ParseLayer(name string) (Layer, bool) {
+	layer, ok := layerNames[strings.ToLower(name)]
+	return layer, ok
+}
+
+func (l Layer) String() string {
+	switch l {
+	case LayerLow:
+		return "low"
+	case LayerMid:
+		return "mid"
+	case LayerHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+func layerForRID(rid string) Layer {
+	if layer, ok := ridLayers[strings.ToLower(rid)]; ok {
+		return layer
+	}
+	return LayerMid
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe, so a
+// subscriber can switch to its layer without corrupting the picture. Codecs
+// without inter frame dependencies always report true.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	default:
+		return true
+	}
+}
+
+// isVP8Keyframe parses the VP8 payload descriptor (RFC 7741) and checks the
+// frame type bit of the first partition.
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// Only the start of partition 0 carries the frame header
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		extension := payload[1]
+		offset++
+		if extension&0x80 != 0 {
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if extension&0x40 != 0 {
+			offset++
+		}
+		if extension&0x30 != 0 {
+			offset++
+		}
+	}
+
+	if len(payload) <= offset {
+		return false
+	}
+	return payload[offset]&0x01 == 0
+}
+
+// isVP9Keyframe checks the VP9 payload descriptor for the start of a frame
+// that does not reference earlier pictures.
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+// isH264Keyframe looks for IDR slices or parameter sets in single NAL unit,
+// STAP-A and FU-A packets (RFC 6184).
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 5, 7:
+		return true
+	case 24:
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				return false
+			}
+			if t := payload[offset] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			offset += size
+		}
+	case 28:
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == 5
+	}
+	return false
+}
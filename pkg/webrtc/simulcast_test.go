@@ -0,0 +1,61 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		// VP8 (RFC 7741)
+		{name: "vp8 keyframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10, 0x00}, want: true},
+		{name: "vp8 interframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10, 0x01}},
+		{name: "vp8 continuation", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x00, 0x00}},
+		{name: "vp8 other partition", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x11, 0x00}},
+		{name: "vp8 15 bit picture ID", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x81, 0x23, 0x00}, want: true},
+		{name: "vp8 7 bit picture ID, TL0PICIDX and TID", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0xE0, 0x05, 0x07, 0x20, 0x00}, want: true},
+		{name: "vp8 extended interframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x05, 0x01}},
+		{name: "vp8 truncated extension", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90}},
+		{name: "vp8 truncated picture ID", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80}},
+		{name: "vp8 without frame header", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10}},
+		{name: "vp8 empty", mimeType: webrtc.MimeTypeVP8},
+		{name: "vp8 mime type case", mimeType: "video/vp8", payload: []byte{0x10, 0x00}, want: true},
+
+		// VP9
+		{name: "vp9 keyframe", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x08}, want: true},
+		{name: "vp9 keyframe with picture ID", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x88}, want: true},
+		{name: "vp9 predicted frame", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x48}},
+		{name: "vp9 continuation", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x00}},
+		{name: "vp9 empty", mimeType: webrtc.MimeTypeVP9},
+
+		// H264 (RFC 6184)
+		{name: "h264 IDR", mimeType: webrtc.MimeTypeH264, payload: []byte{0x65}, want: true},
+		{name: "h264 SPS", mimeType: webrtc.MimeTypeH264, payload: []byte{0x67}, want: true},
+		{name: "h264 non-IDR slice", mimeType: webrtc.MimeTypeH264, payload: []byte{0x41}},
+		{name: "h264 STAP-A with SPS", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xCE}, want: true},
+		{name: "h264 STAP-A with SPS second", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x01, 0x68, 0x00, 0x01, 0x67}, want: true},
+		{name: "h264 STAP-A of slices", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x01, 0x41, 0x00, 0x01, 0x41}},
+		{name: "h264 truncated STAP-A", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x05}},
+		{name: "h264 FU-A start of IDR", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C, 0x85}, want: true},
+		{name: "h264 FU-A middle of IDR", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C, 0x05}},
+		{name: "h264 FU-A start of slice", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C, 0x81}},
+		{name: "h264 truncated FU-A", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C}},
+		{name: "h264 empty", mimeType: webrtc.MimeTypeH264},
+
+		{name: "audio", mimeType: webrtc.MimeTypeOpus, payload: []byte{0x00}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isKeyframe(test.mimeType, test.payload); got != test.want {
+				t.Errorf("isKeyframe(%s, % x) = %v, want %v", test.mimeType, test.payload, got, test.want)
+			}
+		})
+	}
+}
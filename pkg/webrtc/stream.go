@@ -1,7 +1,6 @@
 package webrtc
 
 import (
-	"encoding/json"
 	"log"
 	"os"
 	"sync"
@@ -10,7 +9,13 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-func CustomStreamConnection(c *websocket.Conn, p *CustomPeerManager) {
+func CustomStreamConnection(c *websocket.Conn, participant *Participant, p *CustomPeerManager) {
+	if err := p.join(); err != nil {
+		log.Println(err)
+		return
+	}
+	defer p.leave()
+
 	config := getWebRTCConfiguration()
 	peerConnection := createPeerConnectionStream(config)
 	if peerConnection == nil {
@@ -18,14 +23,18 @@ func CustomStreamConnection(c *websocket.Conn, p *CustomPeerManager) {
 	}
 	defer peerConnection.Close()
 
-	newPeer := addPeerConnectionToListStream(peerConnection, c, p)
+	newPeer, err := addPeerConnectionToListStream(peerConnection, c, participant, p)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	defer removePeerConnectionFromListStream(newPeer, p)
 
 	setupPeerConnectionCallbacksStream(peerConnection, newPeer, p)
 
 	p.SignalPeerConnectionHelper()
 
-	handleWebSocketMessages(c, peerConnection)
+	handleIncomingData(c, newPeer, p)
 }
 
 func getWebRTCConfiguration() webrtc.Configuration {
@@ -37,7 +46,7 @@ func getWebRTCConfiguration() webrtc.Configuration {
 }
 
 func createPeerConnectionStream(config webrtc.Configuration) *webrtc.PeerConnection {
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := newCustomPeerConnection(config)
 	if err != nil {
 		log.Print(err)
 		return nil
@@ -55,22 +64,29 @@ func createPeerConnectionStream(config webrtc.Configuration) *webrtc.PeerConnect
 	return peerConnection
 }
 
-func addPeerConnectionToListStream(peerConnection *webrtc.PeerConnection, c *websocket.Conn, p *CustomPeerManager) CustomPeerConnectionState {
+func addPeerConnectionToListStream(peerConnection *webrtc.PeerConnection, c *websocket.Conn, participant *Participant, p *CustomPeerManager) (CustomPeerConnectionState, error) {
 	newPeer := CustomPeerConnectionState{
+		Participant:    participant,
 		PeerConnection: peerConnection,
 		Websocket: &CustomThreadSafeWriter{
-			Conn:  c,
-			Mutex: sync.Mutex{},
+			Conn:    c,
+			Mutex:   sync.Mutex{},
+			Version: negotiateSignalingVersion(c),
 		},
+		Subscription: NewSubscription(),
+		offerPending: true,
 	}
 
 	p.ListLock.Lock()
-	p.Connections = append(p.Connections, newPeer)
-	p.ListLock.Unlock()
-
-	log.Println(p.Connections)
+	defer p.ListLock.Unlock()
 
-	return newPeer
+	if err := p.addParticipant(participant); err != nil {
+		newPeer.Websocket.writeSignalError("", newSignalingError(ErrorCodeParticipantExists, err))
+		return newPeer, err
+	}
+	p.Connections = append(p.Connections, newPeer)
+	p.sendParticipants(newPeer)
+	return newPeer, nil
 }
 
 func removePeerConnectionFromListStream(newPeer CustomPeerConnectionState, p *CustomPeerManager) {
@@ -78,6 +94,8 @@ func removePeerConnectionFromListStream(newPeer CustomPeerConnectionState, p *Cu
 	defer p.ListLock.Unlock()
 
 	p.Connections = removeCustomConnection(p.Connections, &newPeer)
+	p.unsubscribeAll(newPeer.Participant.ID)
+	p.removeParticipant(newPeer.Participant.ID)
 }
 
 func setupPeerConnectionCallbacksStream(peerConnection *webrtc.PeerConnection, newPeer CustomPeerConnectionState, p *CustomPeerManager) {
@@ -86,16 +104,7 @@ func setupPeerConnectionCallbacksStream(peerConnection *webrtc.PeerConnection, n
 			return
 		}
 
-		candidateString, err := json.Marshal(i.ToJSON())
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		if writeErr := newPeer.Websocket.WriteJSON(&CustomWebSocketMessage{
-			Event: "custom-candidate",
-			Data:  string(candidateString),
-		}); writeErr != nil {
+		if writeErr := newPeer.Websocket.WriteSignal(SignalCandidate, "", i.ToJSON()); writeErr != nil {
 			log.Println(writeErr)
 		}
 	})
@@ -115,24 +124,3 @@ func handleConnectionStateChangeStream(pp webrtc.PeerConnectionState, peerConnec
 		p.SignalPeerConnectionHelper()
 	}
 }
-
-func handleWebSocketMessages(c *websocket.Conn, peerConnection *webrtc.PeerConnection) {
-	message := &CustomWebSocketMessage{}
-	for {
-		_, raw, err := c.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			return
-		} else if err := json.Unmarshal(raw, &message); err != nil {
-			log.Println(err)
-			return
-		}
-
-		switch message.Event {
-		case "custom-candidate":
-			handleICECandidate(message.Data, peerConnection)
-		case "custom-answer":
-			handleSessionAnswer(message.Data, peerConnection)
-		}
-	}
-}
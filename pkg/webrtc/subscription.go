@@ -0,0 +1,93 @@
+package webrtc
+
+import "sync"
+
+// Subscription selects the published tracks a peer receives. A new peer
+// receives every track, unsubscribing from specific tracks or participants
+// excludes them and subscribing to them again lifts the exclusion. After
+// unsubscribing from every track, the peer receives only the tracks and
+// participants it subscribes to.
+type Subscription struct {
+	mu           sync.Mutex
+	all          bool
+	tracks       map[string]bool // Included track IDs, excluded ones while all is set
+	participants map[string]bool // Included publisher IDs, excluded ones while all is set
+}
+
+// NewSubscription creates a subscription to every track.
+func NewSubscription() *Subscription {
+	return &Subscription{
+		all:          true,
+		tracks:       make(map[string]bool),
+		participants: make(map[string]bool),
+	}
+}
+
+// Wants reports whether a track of the given publisher should be forwarded.
+func (s *Subscription) Wants(trackID, publisherID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listed := s.tracks[trackID] || s.participants[publisherID]
+	if s.all {
+		return !listed
+	}
+	return listed
+}
+
+// Subscribe adds tracks and publishers to the subscription, or subscribes to
+// every track if all is set.
+func (s *Subscription) Subscribe(all bool, trackIDs, participantIDs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if all {
+		s.reset(true)
+		return
+	}
+
+	for _, trackID := range trackIDs {
+		s.setListed(s.tracks, trackID, !s.all)
+	}
+	for _, participantID := range participantIDs {
+		s.setListed(s.participants, participantID, !s.all)
+	}
+}
+
+// Unsubscribe removes tracks and publishers from the subscription, or
+// unsubscribes from every track if all is set.
+func (s *Subscription) Unsubscribe(all bool, trackIDs, participantIDs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if all {
+		s.reset(false)
+		return
+	}
+
+	for _, trackID := range trackIDs {
+		s.setListed(s.tracks, trackID, s.all)
+	}
+	for _, participantID := range participantIDs {
+		s.setListed(s.participants, participantID, s.all)
+	}
+}
+
+// setListed adds an ID to, or drops it from, the included IDs, or the
+// excluded ones while subscribed to every track. The caller must hold the
+// lock.
+func (s *Subscription) setListed(ids map[string]bool, id string, listed bool) {
+	if listed {
+		ids[id] = true
+		return
+	}
+	delete(ids, id)
+}
+
+// reset clears the listed tracks and publishers. The caller must hold the
+// lock.
+func (s *Subscription) reset(all bool) {
+	s.all = all
+	s.tracks = make(map[string]bool)
+	s.participants = make(map[string]bool)
+}
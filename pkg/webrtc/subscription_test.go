@@ -0,0 +1,123 @@
+package webrtc
+
+import "testing"
+
+func TestSubscription(t *testing.T) {
+	type change struct {
+		subscribe    bool
+		all          bool
+		tracks       []string
+		participants []string
+	}
+
+	tests := []struct {
+		name    string
+		changes []change
+		wants   map[[2]string]bool // Keyed by track ID and publisher ID
+	}{
+		{
+			name: "every track by default",
+			wants: map[[2]string]bool{
+				{"a", "alice"}: true,
+				{"b", "bob"}:   true,
+			},
+		},
+		{
+			name:    "unsubscribe excludes a track",
+			changes: []change{{tracks: []string{"a"}}},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: false,
+				{"b", "alice"}: true,
+			},
+		},
+		{
+			name:    "unsubscribe excludes a publisher",
+			changes: []change{{participants: []string{"alice"}}},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: false,
+				{"b", "bob"}:   true,
+			},
+		},
+		{
+			name: "subscribing again lifts the exclusion only",
+			changes: []change{
+				{tracks: []string{"a", "b"}},
+				{subscribe: true, tracks: []string{"a"}},
+			},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: true,
+				{"b", "alice"}: false,
+				{"c", "bob"}:   true,
+			},
+		},
+		{
+			name:    "subscribing to a track while receiving every track keeps the others",
+			changes: []change{{subscribe: true, tracks: []string{"a"}}},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: true,
+				{"b", "bob"}:   true,
+			},
+		},
+		{
+			name: "only the subscribed tracks after unsubscribing from all",
+			changes: []change{
+				{all: true},
+				{subscribe: true, tracks: []string{"a"}, participants: []string{"bob"}},
+			},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: true,
+				{"b", "alice"}: false,
+				{"c", "bob"}:   true,
+			},
+		},
+		{
+			name: "unsubscribe drops an included track",
+			changes: []change{
+				{all: true},
+				{subscribe: true, tracks: []string{"a", "b"}},
+				{tracks: []string{"a"}},
+			},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: false,
+				{"b", "alice"}: true,
+			},
+		},
+		{
+			name: "subscribe to all clears the exclusions",
+			changes: []change{
+				{tracks: []string{"a"}, participants: []string{"bob"}},
+				{subscribe: true, all: true},
+			},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: true,
+				{"b", "bob"}:   true,
+			},
+		},
+		{
+			name:    "unsubscribe from all",
+			changes: []change{{all: true}},
+			wants: map[[2]string]bool{
+				{"a", "alice"}: false,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSubscription()
+			for _, c := range test.changes {
+				if c.subscribe {
+					s.Subscribe(c.all, c.tracks, c.participants)
+				} else {
+					s.Unsubscribe(c.all, c.tracks, c.participants)
+				}
+			}
+
+			for ids, want := range test.wants {
+				if got := s.Wants(ids[0], ids[1]); got != want {
+					t.Errorf("Wants(%q, %q) = %v, want %v", ids[0], ids[1], got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package webrtc
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrNoTracks = errors.New("no tracks are being published")
+
+// CustomWHEPConnection accepts a WHEP viewer and sends it every track that is
+// currently published in the manager. WHEP has no channel for server
+// initiated renegotiation, so tracks published later need a new session.
+// It returns the session ID and the SDP answer.
+func CustomWHEPConnection(offerSDP string, p *CustomPeerManager) (string, string, error) {
+	peerConnection, err := newCustomPeerConnection(getWebRTCConfiguration())
+	if err != nil {
+		return "", "", err
+	}
+
+	sessionID := newSessionID()
+	if err := subscribeCustomTracks(peerConnection, p, sessionID); err != nil {
+		peerConnection.Close()
+		p.unsubscribeSession(sessionID)
+		return "", "", err
+	}
+
+	// The down-tracks must not outlive a session that could not start, such
+	// as one in a closing room
+	started, answer, err := p.startCustomSession(sessionID, peerConnection, offerSDP)
+	if err != nil {
+		p.unsubscribeSession(sessionID)
+	}
+	return started, answer, err
+}
+
+func subscribeCustomTracks(peerConnection *webrtc.PeerConnection, p *CustomPeerManager, subscriberID string) error {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	if len(p.Tracks) == 0 {
+		return ErrNoTracks
+	}
+
+	for _, router := range p.Tracks {
+		if err := subscribeTrack(peerConnection, router, subscriberID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package webrtc
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// CustomWHIPConnection accepts a WHIP publisher. The publisher joins the
+// manager as a participant and the tracks it sends are forwarded to the other
+// peers like those of any websocket publisher. It returns the session ID and
+// the SDP answer, or ErrParticipantExists if the participant is already in the
+// room.
+func CustomWHIPConnection(offerSDP string, participant *Participant, p *CustomPeerManager) (string, string, error) {
+	peerConnection := createPeerConnectionStream(getWebRTCConfiguration())
+	if peerConnection == nil {
+		return "", "", errPeerConnectionCreate
+	}
+
+	peerConnection.OnTrack(func(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if err := handleIncomingTrack(t, receiver, participant, p); err != nil {
+			log.Printf("whip track rejected: %v", err)
+		}
+	})
+
+	p.ListLock.Lock()
+	err := p.addParticipant(participant)
+	p.ListLock.Unlock()
+	if err != nil {
+		peerConnection.Close()
+		return "", "", err
+	}
+
+	// The session ID is random rather than the participant ID, which comes
+	// from the access token and may be known to others
+	sessionID := newSessionID()
+	p.SessionsLock.Lock()
+	p.publishers[sessionID] = participant.ID
+	p.SessionsLock.Unlock()
+
+	started, answer, err := p.startCustomSession(sessionID, peerConnection, offerSDP)
+	if err != nil {
+		p.removeCustomSession(sessionID)
+	}
+	return started, answer, err
+}